@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+type (
+	// ACLRule contains the actions a sender may send and the templates it may act on.
+	// Without templates, the sender may act on all of them.
+	ACLRule struct {
+		Actions   []string `json:"actions"`
+		Templates []string `json:"templates"`
+	}
+)
+
+var (
+	defaultACL = map[string]*ACLRule{
+		payloadSenderProxy: &ACLRule{
+			Actions: []string{payloadActionCreate, payloadActionDelete, payloadActionQuery},
+		},
+		payloadSenderDroplets: &ACLRule{
+			Actions: []string{payloadActionIdentify, payloadActionHeartbeat},
+		},
+	}
+	errForbidden = errors.New("action not permitted for sender")
+)
+
+// isValidACL checks whether every rule of the ACL is set.
+// The ACL requires signing, as the sender of a payload carrying the shared token can not be trusted.
+func (c *Config) isValidACL() bool {
+	if len(c.ACL) > 0 && !c.isSigning() {
+		slog.Error("The ACL requires payloads to be signed, configure the signing senders.")
+		return false
+	}
+	for _, rule := range c.ACL {
+		if rule == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// aclRule gets the rule of a sender.
+// Droplets without a rule of their own fall back to the rule of all droplets.
+func aclRule(sender string) *ACLRule {
+	if sender != payloadSenderDroplets {
+		if rule := senderRule(sender); rule != nil {
+			return rule
+		}
+	}
+	if droplets.contains(sender) {
+		return senderRule(payloadSenderDroplets)
+	}
+	return nil
+}
+
+// senderRule gets the configured rule of the sender, which overrides its default rule.
+func senderRule(sender string) *ACLRule {
+	if rule := config.ACL[sender]; rule != nil {
+		return rule
+	}
+	return defaultACL[sender]
+}
+
+// authorizePayload checks whether the sender may send the action, concerning the template and droplet if given.
+// Droplets may only act as themselves.
+func authorizePayload(payload *Payload, template, target string) error {
+	rule := aclRule(payload.Sender)
+	if rule == nil || !contains(rule.Actions, payload.Action) {
+		return errForbidden
+	}
+	if template != "" && len(rule.Templates) > 0 && !contains(rule.Templates, template) {
+		return errForbidden
+	}
+	if target != "" && target != payload.Sender && droplets.contains(payload.Sender) {
+		return errForbidden
+	}
+	return nil
+}
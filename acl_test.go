@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestAuthorizePayload checks the default rules, configured rules and that droplets only act as themselves.
+func TestAuthorizePayload(t *testing.T) {
+	config.ACL = map[string]*ACLRule{
+		"lobby": &ACLRule{
+			Actions:   []string{payloadActionCreate},
+			Templates: []string{"game"},
+		},
+		"acl-2": &ACLRule{
+			Actions: []string{payloadActionIdentify, payloadActionQuery},
+		},
+	}
+	defer func() {
+		config.ACL = nil
+	}()
+	template := &Template{Name: "acl"}
+	droplets.put("acl-1", &droplet{identifier: "acl-1", template: template})
+	droplets.put("acl-2", &droplet{identifier: "acl-2", template: template})
+	defer droplets.remove("acl-1")
+	defer droplets.remove("acl-2")
+	tests := []struct {
+		name     string
+		sender   string
+		action   string
+		template string
+		target   string
+		err      error
+	}{
+		{"proxy creates", payloadSenderProxy, payloadActionCreate, "game", "", nil},
+		{"proxy deletes", payloadSenderProxy, payloadActionDelete, "acl", "acl-1", nil},
+		{"proxy queries", payloadSenderProxy, payloadActionQuery, "", "", nil},
+		{"proxy identifies", payloadSenderProxy, payloadActionIdentify, "", "", errForbidden},
+		{"droplet identifies", "acl-1", payloadActionIdentify, "", "acl-1", nil},
+		{"droplet beats", "acl-1", payloadActionHeartbeat, "", "", nil},
+		{"droplet identifies as another", "acl-1", payloadActionIdentify, "", "acl-2", errForbidden},
+		{"droplet creates", "acl-1", payloadActionCreate, "game", "", errForbidden},
+		{"droplet deletes", "acl-1", payloadActionDelete, "acl", "acl-1", errForbidden},
+		{"all droplets as sender", payloadSenderDroplets, payloadActionIdentify, "", "", errForbidden},
+		{"handler", payloadSenderHandler, payloadActionCreate, "game", "", errForbidden},
+		{"unknown sender", "stranger", payloadActionQuery, "", "", errForbidden},
+		{"configured sender creates", "lobby", payloadActionCreate, "game", "", nil},
+		{"configured sender creates other template", "lobby", payloadActionCreate, "acl", "", errForbidden},
+		{"configured sender deletes", "lobby", payloadActionDelete, "game", "", errForbidden},
+		{"configured droplet queries", "acl-2", payloadActionQuery, "", "", nil},
+		{"configured droplet beats", "acl-2", payloadActionHeartbeat, "", "", errForbidden},
+		{"configured droplet identifies as another", "acl-2", payloadActionIdentify, "", "acl-1", errForbidden},
+	}
+	for _, test := range tests {
+		payload := &Payload{
+			Action: test.action,
+			Sender: test.sender,
+		}
+		if err := authorizePayload(payload, test.template, test.target); err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+// TestIsValidACL checks that an ACL is only accepted together with signing.
+func TestIsValidACL(t *testing.T) {
+	rule := &ACLRule{
+		Actions: []string{payloadActionQuery},
+	}
+	signers := map[string]*SenderConfig{
+		payloadSenderHandler: &SenderConfig{Secret: "handler"},
+	}
+	tests := []struct {
+		name    string
+		acl     map[string]*ACLRule
+		senders map[string]*SenderConfig
+		valid   bool
+	}{
+		{"no ACL with token", nil, nil, true},
+		{"no ACL with signing", nil, signers, true},
+		{"ACL with token", map[string]*ACLRule{payloadSenderProxy: rule}, nil, false},
+		{"ACL with signing", map[string]*ACLRule{payloadSenderProxy: rule}, signers, true},
+		{"unset rule", map[string]*ACLRule{payloadSenderProxy: nil}, signers, false},
+	}
+	for _, test := range tests {
+		c := &Config{
+			ACL: test.acl,
+		}
+		c.Signing.Senders = test.senders
+		if valid := c.isValidACL(); valid != test.valid {
+			t.Errorf("%s: got %t, expected %t", test.name, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// AdminDroplet represents a droplet in the admin API.
+	AdminDroplet struct {
+		*PayloadDroplet
+		Template string  `json:"template"`
+		State    string  `json:"state"`
+		Warm     bool    `json:"warm"`
+		Uptime   int64   `json:"uptime"`
+		TPS      float64 `json:"tps"`
+		Players  int     `json:"players"`
+	}
+	// AdminCreateRequest represents a create request in the admin API.
+	AdminCreateRequest struct {
+		Template string `json:"template"`
+		Data     string `json:"data"`
+	}
+	// AdminTemplate represents a template and its validation results in the admin API.
+	AdminTemplate struct {
+		*templateReport
+		Registered bool `json:"registered"`
+	}
+	adminError struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+const (
+	adminSocketPrefix = "unix:"
+)
+
+// listenAdmin starts the admin API on the configured TCP address or Unix socket.
+func listenAdmin() {
+	network, address := "tcp", config.Admin.Address
+	if strings.HasPrefix(address, adminSocketPrefix) {
+		network, address = "unix", strings.TrimPrefix(address, adminSocketPrefix)
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		slog.Error("Could not start admin API.", "error", err)
+		return
+	}
+	slog.Info("Admin API listening.", "address", config.Admin.Address)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/droplets", adminAuthenticated(adminDroplets))
+	mux.HandleFunc("/droplets/", adminAuthenticated(adminDroplet))
+	mux.HandleFunc("/templates", adminAuthenticated(adminTemplates))
+	mux.HandleFunc("/templates/reload", adminAuthenticated(adminReload))
+	err = http.Serve(listener, mux)
+	if err != nil {
+		slog.Error("Admin API stopped.", "error", err)
+	}
+}
+
+// adminAuthenticated wraps a handler with bearer token authentication.
+func adminAuthenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			adminRespond(writer, http.StatusUnauthorized, &adminError{Error: "unauthorized"})
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// adminDroplets lists all droplets or creates a new one.
+func adminDroplets(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		list := make([]*AdminDroplet, 0)
+		droplets.forAllDroplets(func(droplet *droplet) {
+			list = append(list, droplet.toAdminEntity())
+		})
+		adminRespond(writer, http.StatusOK, list)
+	case http.MethodPost:
+		var data AdminCreateRequest
+		if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
+			adminRespond(writer, http.StatusBadRequest, &adminError{Error: err.Error()})
+			return
+		}
+		template := templates.get(data.Template)
+		if template == nil {
+			adminRespond(writer, http.StatusNotFound, &adminError{Error: "unknown template"})
+			return
+		}
+		droplet, err := createDroplet(template, data.Data)
+		if reason, rejected := rejectReasons[err]; rejected {
+			adminRespond(writer, http.StatusConflict, &adminError{Error: err.Error(), Reason: reason})
+		} else if err != nil {
+			adminRespond(writer, http.StatusInternalServerError, &adminError{Error: err.Error()})
+		} else {
+			adminRespond(writer, http.StatusCreated, droplet.toAdminEntity())
+		}
+	default:
+		adminRespond(writer, http.StatusMethodNotAllowed, &adminError{Error: "method not allowed"})
+	}
+}
+
+// adminDroplet deletes or restarts a single droplet.
+func adminDroplet(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/droplets/"), "/")
+	droplet := droplets.get(path[0])
+	if droplet == nil {
+		adminRespond(writer, http.StatusNotFound, &adminError{Error: errDropletDeleted.Error()})
+		return
+	}
+	switch {
+	case len(path) == 1 && request.Method == http.MethodDelete:
+		if droplet.getState() == dropletStateDeleting {
+			adminRespond(writer, http.StatusNotFound, &adminError{Error: errDropletDeleted.Error()})
+			return
+		}
+		go droplet.delete(true)
+		adminRespond(writer, http.StatusAccepted, droplet.toAdminEntity())
+	case len(path) == 2 && path[1] == "restart" && request.Method == http.MethodPost:
+		if droplet.getState() == dropletStateDeleting {
+			adminRespond(writer, http.StatusNotFound, &adminError{Error: errDropletDeleted.Error()})
+			return
+		}
+		if err := droplet.restart(); err != nil {
+			adminRespond(writer, http.StatusInternalServerError, &adminError{Error: err.Error()})
+			return
+		}
+		adminRespond(writer, http.StatusOK, droplet.toAdminEntity())
+	default:
+		adminRespond(writer, http.StatusNotFound, &adminError{Error: "not found"})
+	}
+}
+
+// adminTemplates lists all templates in the template file with their validation results.
+func adminTemplates(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		adminRespond(writer, http.StatusMethodNotAllowed, &adminError{Error: "method not allowed"})
+		return
+	}
+	reports, err := validateTemplates()
+	if err != nil {
+		adminRespond(writer, http.StatusInternalServerError, &adminError{Error: err.Error()})
+		return
+	}
+	list := make([]*AdminTemplate, 0, len(reports))
+	for _, report := range reports {
+		list = append(list, &AdminTemplate{
+			templateReport: report,
+			Registered:     templates.get(report.Template.Name) != nil,
+		})
+	}
+	adminRespond(writer, http.StatusOK, list)
+}
+
+// adminReload reloads the templates.
+func adminReload(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		adminRespond(writer, http.StatusMethodNotAllowed, &adminError{Error: "method not allowed"})
+		return
+	}
+	if err := reloadTemplates(); err != nil {
+		adminRespond(writer, http.StatusInternalServerError, &adminError{Error: err.Error()})
+		return
+	}
+	adminTemplates(writer, &http.Request{Method: http.MethodGet})
+}
+
+// adminRespond writes the value as JSON.
+func adminRespond(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		slog.Warn("Could not write admin response.", "error", err)
+	}
+}
+
+// toAdminEntity converts the droplet to an admin API entity.
+func (d *droplet) toAdminEntity() *AdminDroplet {
+	entity := d.toPayloadEntity()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return &AdminDroplet{
+		PayloadDroplet: entity,
+		Template:       d.template.Name,
+		State:          dropletStateNames[d.getState()],
+		Warm:           d.warm,
+		Uptime:         int64(time.Since(d.created).Seconds()),
+		TPS:            d.tps,
+		Players:        d.players,
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// SenderConfig contains the secret of a payload sender.
+	SenderConfig struct {
+		Secret string `json:"secret"`
+	}
+	replayCache struct {
+		seen  map[string]int64
+		mutex sync.Mutex
+	}
+)
+
+const (
+	payloadSenderDroplets = "droplets"
+	defaultSigningWindow  = 30
+)
+
+var (
+	replays = replayCache{
+		seen: make(map[string]int64),
+	}
+	errBadToken      = errors.New("wrong payload token")
+	errUnknownSender = errors.New("unknown payload sender")
+	errBadSignature  = errors.New("wrong payload signature")
+	errReplayWindow  = errors.New("payload timestamp outside of replay window")
+	errReplayed      = errors.New("payload replayed")
+)
+
+// isSigning checks whether payloads are signed with per-sender secrets instead of the shared token.
+func (c *Config) isSigning() bool {
+	return len(c.Signing.Senders) > 0
+}
+
+// isValidSigning checks whether the handler and every configured sender have a secret.
+func (c *Config) isValidSigning() bool {
+	if !c.isSigning() {
+		return c.Token != ""
+	}
+	if c.Signing.Senders[payloadSenderHandler] == nil || c.Signing.Window < 0 {
+		return false
+	}
+	for _, sender := range c.Signing.Senders {
+		if sender == nil || sender.Secret == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// signingWindow gets the maximum age of a signed payload.
+func signingWindow() time.Duration {
+	if config.Signing.Window != 0 {
+		return time.Duration(config.Signing.Window) * time.Second
+	}
+	return defaultSigningWindow * time.Second
+}
+
+// authenticatePayload adds the credentials of the sender to an outgoing payload.
+// Signed payloads do not carry the shared token.
+func authenticatePayload(payload *Payload) {
+	if !config.isSigning() {
+		payload.Token = config.Token
+		return
+	}
+	sender := config.Signing.Senders[payload.Sender]
+	if sender == nil {
+		return
+	}
+	payload.Timestamp = time.Now().Unix()
+	payload.Signature = payloadSignature(payload, sender.Secret)
+}
+
+// verifyPayload checks the credentials of an incoming payload the transport received at the time.
+// Signed payloads have to be signed within the window of that time. For stream entries it is when they were added,
+// so entries reclaimed after a restart of the handler are not rejected as replays.
+func verifyPayload(payload *Payload, received time.Time) error {
+	if !config.isSigning() {
+		if subtle.ConstantTimeCompare([]byte(payload.Token), []byte(config.Token)) != 1 {
+			return errBadToken
+		}
+		return nil
+	}
+	secret := senderSecret(payload.Sender)
+	if secret == "" {
+		return errUnknownSender
+	}
+	sent := time.Unix(payload.Timestamp, 0)
+	if age := received.Sub(sent); age > signingWindow() || age < -signingWindow() {
+		return errReplayWindow
+	}
+	expected, _ := hex.DecodeString(payloadSignature(payload, secret))
+	actual, err := hex.DecodeString(payload.Signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return errBadSignature
+	}
+	if !replays.check(payload.Signature, payload.Timestamp) {
+		return errReplayed
+	}
+	return nil
+}
+
+// senderSecret gets the secret of a sender.
+// Droplets share one entry, each signing with a secret derived from it and its identifier.
+func senderSecret(sender string) string {
+	if droplets.contains(sender) {
+		return dropletSecret(sender)
+	}
+	entry := config.Signing.Senders[sender]
+	if entry == nil || sender == payloadSenderDroplets {
+		return ""
+	}
+	return entry.Secret
+}
+
+// dropletSecret derives the secret a droplet signs its payloads with.
+// It is empty if droplets are not configured as senders.
+func dropletSecret(identifier string) string {
+	class := config.Signing.Senders[payloadSenderDroplets]
+	if class == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(class.Secret))
+	mac.Write([]byte(identifier))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// payloadSignature calculates the signature over the action, sender, data and timestamp of the payload.
+func payloadSignature(payload *Payload, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range []string{payload.Action, payload.Sender, string(payload.Data), strconv.FormatInt(payload.Timestamp, 10)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// check records the signature and reports whether it was not seen within the replay window.
+func (r *replayCache) check(signature string, timestamp int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expired := time.Now().Add(-signingWindow()).Unix()
+	for seen, sent := range r.seen {
+		if sent < expired {
+			delete(r.seen, seen)
+		}
+	}
+	if _, replayed := r.seen[signature]; replayed {
+		return false
+	}
+	r.seen[signature] = timestamp
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestVerifyPayload checks the token, signature and replay window of incoming payloads.
+func TestVerifyPayload(t *testing.T) {
+	config.Token = "token"
+	config.Signing.Window = 30
+	config.Signing.Senders = nil
+	now := time.Now()
+	tokens := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"token", "token", nil},
+		{"wrong token", "other", errBadToken},
+		{"no token", "", errBadToken},
+	}
+	for _, test := range tokens {
+		payload := &Payload{Action: payloadActionQuery, Sender: payloadSenderProxy, Token: test.token}
+		if err := verifyPayload(payload, now); err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	config.Signing.Senders = map[string]*SenderConfig{
+		payloadSenderHandler:  &SenderConfig{Secret: "handler"},
+		payloadSenderProxy:    &SenderConfig{Secret: "proxy"},
+		payloadSenderDroplets: &SenderConfig{Secret: "droplets"},
+	}
+	defer func() {
+		config.Signing.Senders = nil
+	}()
+	droplets.put("verify-1", &droplet{identifier: "verify-1", template: &Template{Name: "verify"}})
+	defer droplets.remove("verify-1")
+	signatures := []struct {
+		name     string
+		sender   string
+		secret   string
+		age      time.Duration
+		received time.Duration
+		tamper   func(*Payload)
+		err      error
+	}{
+		{"proxy", payloadSenderProxy, "proxy", 0, 0, nil, nil},
+		{"droplet", "verify-1", dropletSecret("verify-1"), 0, 0, nil, nil},
+		{"droplet with the secret of all droplets", "verify-1", "droplets", 0, 0, nil, errBadSignature},
+		{"all droplets as sender", payloadSenderDroplets, "droplets", 0, 0, nil, errUnknownSender},
+		{"unknown sender", "stranger", "proxy", 0, 0, nil, errUnknownSender},
+		{"wrong secret", payloadSenderProxy, "handler", 0, 0, nil, errBadSignature},
+		{"changed data", payloadSenderProxy, "proxy", 0, 0, func(payload *Payload) {
+			payload.Data = json.RawMessage(`"changed"`)
+		}, errBadSignature},
+		{"changed sender", payloadSenderProxy, "proxy", 0, 0, func(payload *Payload) {
+			payload.Sender = payloadSenderHandler
+		}, errBadSignature},
+		{"malformed signature", payloadSenderProxy, "proxy", 0, 0, func(payload *Payload) {
+			payload.Signature = "signature"
+		}, errBadSignature},
+		{"too old", payloadSenderProxy, "proxy", time.Minute, 0, nil, errReplayWindow},
+		{"from the future", payloadSenderProxy, "proxy", -time.Minute, 0, nil, errReplayWindow},
+		{"old but received in time", payloadSenderProxy, "proxy", 2 * time.Minute, 110 * time.Second, nil, nil},
+	}
+	for _, test := range signatures {
+		payload := &Payload{
+			Action:    payloadActionQuery,
+			Sender:    test.sender,
+			Data:      json.RawMessage(`"` + test.name + `"`),
+			Timestamp: now.Add(-test.age).Unix(),
+		}
+		payload.Signature = payloadSignature(payload, test.secret)
+		if test.tamper != nil {
+			test.tamper(payload)
+		}
+		if err := verifyPayload(payload, now.Add(-test.received)); err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	payload := &Payload{
+		Action:    payloadActionQuery,
+		Sender:    payloadSenderProxy,
+		Data:      json.RawMessage(`"replay"`),
+		Timestamp: now.Unix(),
+	}
+	payload.Signature = payloadSignature(payload, "proxy")
+	if err := verifyPayload(payload, now); err != nil {
+		t.Fatalf("first delivery: got %v, expected none", err)
+	}
+	if err := verifyPayload(payload, now); err != errReplayed {
+		t.Errorf("replay: got %v, expected %v", err, errReplayed)
+	}
+}
+
+// TestReplayCacheCheck checks that signatures are only accepted once within the replay window.
+func TestReplayCacheCheck(t *testing.T) {
+	config.Signing.Window = 30
+	cache := &replayCache{
+		seen: make(map[string]int64),
+	}
+	now := time.Now()
+	steps := []struct {
+		name      string
+		signature string
+		age       time.Duration
+		fresh     bool
+	}{
+		{"first", "a", 0, true},
+		{"repeated", "a", 0, false},
+		{"other", "b", 0, true},
+		{"repeated after other", "a", 10 * time.Second, false},
+		// Payloads this old are rejected by their timestamp, so their signatures are not kept.
+		{"expired", "c", time.Minute, true},
+		{"expired repeated", "c", time.Minute, true},
+		{"other repeated", "b", 0, false},
+	}
+	for _, step := range steps {
+		if fresh := cache.check(step.signature, now.Add(-step.age).Unix()); fresh != step.fresh {
+			t.Errorf("%s: got %t, expected %t", step.name, fresh, step.fresh)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+const (
+	instanceCheckInterval = 30 * time.Second
+)
+
+// maintainInstances keeps the warm pool filled and the minimum amount of instances of every template running.
+// In cluster mode, only the leader does so for the whole cluster, while every node drains its own outdated warm droplets.
+func maintainInstances() {
+	for {
+		if !isShuttingDown() {
+			drainWarm()
+		}
+		// The leader waits for the first view of the cluster, so it does not count it empty.
+		if isLeader() && !isShuttingDown() && (!config.isCluster() || cluster.count() > 0) {
+			for _, template := range templates.all() {
+				warm := template.WarmPool - countInstances(template, true)
+				for i := 0; i < warm; i++ {
+					slog.Info("Warm pool of template is not full, creating droplet.", "template", template.Name)
+					go func(template *Template) {
+						err := spawnDroplet(template, true)
+						if err != nil {
+							slog.Error("Error creating warm droplet.", "template", template.Name, "error", err)
+						}
+					}(template)
+				}
+				missing := template.MinInstances - countInstances(template, false)
+				for i := 0; i < missing; i++ {
+					slog.Info("Template is below its minimum instances, creating droplet.", "template", template.Name)
+					go func(template *Template) {
+						err := spawnDroplet(template, false)
+						if err != nil {
+							slog.Error("Error creating minimum instance.", "template", template.Name, "error", err)
+						}
+					}(template)
+				}
+			}
+		}
+		time.Sleep(instanceCheckInterval)
+	}
+}
+
+// countInstances counts the droplets of the template, or only the unassigned warm ones, on all nodes in cluster mode.
+// Warm droplets only count if they were created from the current definition of the template.
+func countInstances(template *Template, warm bool) int {
+	if config.isCluster() {
+		return cluster.instances(template.Name, warm)
+	}
+	if warm {
+		return droplets.countWarm(template)
+	}
+	return droplets.count(template.Name)
+}
+
+// drainWarm deletes the warm droplets of templates that were changed or removed by a reload.
+// They are never claimed, so they would wait in the warm pool for good.
+func drainWarm() {
+	droplets.forAllDroplets(func(droplet *droplet) {
+		if !droplet.isCurrent() && droplet.unwarm() {
+			droplet.logger().Info("Deleting warm droplet of outdated template.")
+			go droplet.delete(true)
+		}
+	})
+}
+
+// spawnDroplet launches a droplet of the template on the node picked by the placement policy.
+// Droplets placed on other nodes are handed to them with a create payload.
+func spawnDroplet(template *Template, warm bool) error {
+	if config.isCluster() {
+		node := cluster.place(template.Name)
+		if node == clusterNoNode {
+			return errNoNode
+		}
+		if node != nodeName() {
+			data, err := json.Marshal(&PayloadCreateData{
+				Template: template.Name,
+				Node:     node,
+				Warm:     warm,
+			})
+			if err != nil {
+				return err
+			}
+			payloadSend(&Payload{
+				Action: payloadActionCreate,
+				Sender: payloadSenderHandler,
+				Data:   data,
+			})
+			return nil
+		}
+	}
+	return template.launchLocal(warm)
+}
+
+// launchLocal launches a droplet of the template on this node.
+func (t *Template) launchLocal(warm bool) error {
+	var err error
+	if warm {
+		_, err = t.launchWarm()
+	} else {
+		_, err = t.launch("")
+	}
+	return err
+}
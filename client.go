@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type (
+	clientCommand struct {
+		usage   string
+		minArgs int
+		run     func(args []string, asJSON bool) error
+	}
+)
+
+const (
+	clientQueryTimeout = 5 * time.Second
+	clientQueryRetry   = 1 * time.Second
+	clientQueryBuffer  = 16
+)
+
+var (
+	clientCommands = map[string]*clientCommand{
+		"list": &clientCommand{
+			usage: "",
+			run:   clientList,
+		},
+		"create": &clientCommand{
+			usage:   "<template> [data]",
+			minArgs: 1,
+			run:     clientCreate,
+		},
+		"delete": &clientCommand{
+			usage:   "<id>",
+			minArgs: 1,
+			run:     clientDelete,
+		},
+		"restart": &clientCommand{
+			usage:   "<id>",
+			minArgs: 1,
+			run:     clientRestart,
+		},
+		"query": &clientCommand{
+			usage: "",
+			run:   clientQuery,
+		},
+		"templates": &clientCommand{
+			usage:   "<validate|reload>",
+			minArgs: 1,
+			run:     clientTemplates,
+		},
+		"send-raw": &clientCommand{
+			usage:   "<payload>",
+			minArgs: 1,
+			run:     clientSendRaw,
+		},
+	}
+	errClientUsage = errors.New("invalid usage")
+)
+
+// runClient runs a client subcommand against a running handler and returns the exit code.
+func runClient(args []string) int {
+	command, exists := clientCommands[args[0]]
+	if !exists {
+		clientUsage()
+		return 2
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the output as JSON")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() < command.minArgs {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", clientUsageLine(args[0]))
+		return 2
+	}
+	if err := loadData(configFile, &config); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load configuration: %s.\n", err.Error())
+		return 1
+	}
+	config.handleDirs()
+	err := command.run(flags.Args(), *asJSON)
+	if err == errClientUsage {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", clientUsageLine(args[0]))
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// clientUsage prints all available subcommands.
+func clientUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  droplets-handler [--force-unlock] start the handler")
+	for _, name := range []string{"list", "create", "delete", "restart", "query", "templates", "send-raw"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", clientUsageLine(name))
+	}
+}
+
+// clientUsageLine formats the usage of a subcommand.
+func clientUsageLine(name string) string {
+	return strings.TrimSpace("droplets-handler " + name + " [--json] " + clientCommands[name].usage)
+}
+
+// clientList lists all droplets of the handler.
+func clientList(args []string, asJSON bool) error {
+	var list []*AdminDroplet
+	if err := clientRequest(http.MethodGet, "/droplets", nil, &list); err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(list)
+	}
+	clientPrintDroplets(list...)
+	return nil
+}
+
+// clientCreate creates a droplet.
+func clientCreate(args []string, asJSON bool) error {
+	data := &AdminCreateRequest{
+		Template: args[0],
+	}
+	if len(args) > 1 {
+		data.Data = args[1]
+	}
+	var droplet AdminDroplet
+	if err := clientRequest(http.MethodPost, "/droplets", data, &droplet); err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(&droplet)
+	}
+	clientPrintDroplets(&droplet)
+	return nil
+}
+
+// clientDelete deletes a droplet.
+func clientDelete(args []string, asJSON bool) error {
+	var droplet AdminDroplet
+	if err := clientRequest(http.MethodDelete, "/droplets/"+args[0], nil, &droplet); err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(&droplet)
+	}
+	fmt.Printf("Deleting droplet %s.\n", droplet.Identifier)
+	return nil
+}
+
+// clientRestart restarts a droplet.
+func clientRestart(args []string, asJSON bool) error {
+	var droplet AdminDroplet
+	if err := clientRequest(http.MethodPost, "/droplets/"+args[0]+"/restart", nil, &droplet); err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(&droplet)
+	}
+	clientPrintDroplets(&droplet)
+	return nil
+}
+
+// clientTemplates validates or reloads the templates of the handler.
+func clientTemplates(args []string, asJSON bool) error {
+	var list []*AdminTemplate
+	var err error
+	switch args[0] {
+	case "validate":
+		err = clientRequest(http.MethodGet, "/templates", nil, &list)
+	case "reload":
+		err = clientRequest(http.MethodPost, "/templates/reload", nil, &list)
+	default:
+		return errClientUsage
+	}
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(list)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tMEMORY\tVALID\tFILES\tREGISTERED")
+	for _, template := range list {
+		fmt.Fprintf(writer, "%s\t%d-%d\t%t\t%t\t%t\n", template.Template.Name, template.Template.MinMemory,
+			template.Template.MaxMemory, template.Valid, template.Files, template.Registered)
+	}
+	return writer.Flush()
+}
+
+// clientQuery sends a query payload and prints the merged replies of the handlers.
+// The query is repeated until a reply arrives, as the subscription may not be ready for the first one.
+// Replies to queries of other senders are told apart by the correlation ID.
+func clientQuery(args []string, asJSON bool) error {
+	if err := conns.connect(); err != nil {
+		return err
+	}
+	defer conns.close()
+	correlation, err := clientCorrelation()
+	if err != nil {
+		return err
+	}
+	replies := make(chan *PayloadQueryData, clientQueryBuffer)
+	failures := make(chan error, 1)
+	go func() {
+		failures <- newTransport("").Subscribe(func(delivery *delivery) {
+			var payload Payload
+			if json.Unmarshal(delivery.message, &payload) != nil ||
+				payload.Action != payloadActionQuery || payload.Sender != payloadSenderHandler ||
+				payload.Correlation != correlation {
+				return
+			}
+			var data PayloadQueryData
+			if json.Unmarshal(payload.Data, &data) != nil {
+				return
+			}
+			select {
+			case replies <- &data:
+			default:
+			}
+		})
+	}()
+	query := &Payload{
+		Action:      payloadActionQuery,
+		Sender:      payloadSenderProxy,
+		Data:        json.RawMessage("{}"),
+		Correlation: correlation,
+	}
+	publisher := newTransport("")
+	retry := time.NewTicker(clientQueryRetry)
+	defer retry.Stop()
+	deadline := time.After(clientQueryTimeout)
+	merged := &PayloadQueryData{
+		Droplets: make([]*PayloadDroplet, 0),
+	}
+	answered := make(map[string]bool)
+	publish := true
+collect:
+	// In cluster mode every node answers with its own droplets, so replies are merged until all nodes answered.
+	for len(answered) == 0 || len(answered) < merged.Nodes {
+		if publish {
+			// Each attempt is signed anew, so it is not taken for a replay.
+			authenticatePayload(query)
+			bytes, err := json.Marshal(query)
+			if err != nil {
+				return err
+			}
+			if err = publisher.Publish(bytes); err != nil {
+				return err
+			}
+			publish = false
+		}
+		select {
+		case data := <-replies:
+			if answered[data.Node] {
+				continue
+			}
+			answered[data.Node] = true
+			merged.Droplets = append(merged.Droplets, data.Droplets...)
+			if data.Nodes > merged.Nodes {
+				merged.Nodes = data.Nodes
+			}
+		case err = <-failures:
+			return err
+		case <-retry.C:
+			publish = true
+		case <-deadline:
+			if len(answered) == 0 {
+				return errors.New("no query reply received")
+			}
+			fmt.Fprintf(os.Stderr, "Only %d of %d nodes replied.\n", len(answered), merged.Nodes)
+			break collect
+		}
+	}
+	if asJSON {
+		return clientPrintJSON(merged)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "IDENTIFIER\tADDRESS\tDATA")
+	for _, droplet := range merged.Droplets {
+		fmt.Fprintf(writer, "%s\t%s:%d\t%s\n", droplet.Identifier, droplet.IP, droplet.Port, droplet.Data)
+	}
+	return writer.Flush()
+}
+
+// clientCorrelation generates a random correlation ID.
+func clientCorrelation() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// clientSendRaw publishes a raw payload.
+func clientSendRaw(args []string, asJSON bool) error {
+	payload := []byte(strings.Join(args, " "))
+	if !json.Valid(payload) {
+		return errors.New("payload is not valid JSON")
+	}
+	if err := clientPublish(payload); err != nil {
+		return err
+	}
+	if asJSON {
+		return clientPrintJSON(json.RawMessage(payload))
+	}
+	fmt.Println("Payload sent.")
+	return nil
+}
+
+// clientPublish publishes the bytes over the configured transport.
+func clientPublish(bytes []byte) error {
+	if err := conns.connect(); err != nil {
+		return err
+	}
+	defer conns.close()
+	return newTransport("").Publish(bytes)
+}
+
+// clientRequest sends a request to the admin API of the running handler.
+func clientRequest(method, path string, body, result interface{}) error {
+	if config.Admin.Address == "" {
+		return errors.New("admin API is not configured")
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	host := config.Admin.Address
+	client := &http.Client{
+		Timeout: 10 * time.Minute,
+	}
+	if strings.HasPrefix(host, adminSocketPrefix) {
+		socket := strings.TrimPrefix(host, adminSocketPrefix)
+		host = "localhost"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	request, err := http.NewRequest(method, "http://"+host+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+config.Admin.Token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		var failure adminError
+		if json.NewDecoder(response.Body).Decode(&failure) != nil || failure.Error == "" {
+			return errors.New(response.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// clientPrintDroplets prints the droplets as a table.
+func clientPrintDroplets(list ...*AdminDroplet) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "IDENTIFIER\tTEMPLATE\tSTATE\tADDRESS\tUPTIME\tPLAYERS\tDATA")
+	for _, droplet := range list {
+		state := droplet.State
+		if droplet.Warm {
+			state += " (warm)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s:%d\t%s\t%s\t%s\n", droplet.Identifier, droplet.Template, state, droplet.IP,
+			droplet.Port, time.Duration(droplet.Uptime)*time.Second, strconv.Itoa(droplet.Players), droplet.Data)
+	}
+	writer.Flush()
+}
+
+// clientPrintJSON prints the value as indented JSON.
+func clientPrintJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
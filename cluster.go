@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// ClusterNode represents a handler registered in the cluster.
+	ClusterNode struct {
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+		Capacity  int               `json:"capacity"`
+		Used      int               `json:"used"`
+		Templates []string          `json:"templates"`
+		Droplets  []string          `json:"droplets"`
+		Instances map[string]int    `json:"instances"`
+		Warm      map[string]int    `json:"warm"`
+	}
+	clusterView struct {
+		nodes []*ClusterNode
+		mutex sync.RWMutex
+	}
+)
+
+const (
+	clusterNodesKey        = "droplets:nodes"
+	clusterNodePrefix      = "droplets:node:"
+	clusterClaimPrefix     = "droplets:claim:"
+	clusterClaimTTL        = 1 * time.Minute
+	clusterNoNode          = "#"
+	clusterDefaultInterval = 10
+	clusterMissedBeats     = 3
+	placementLeastLoaded   = "least-loaded"
+	placementAffinity      = "affinity"
+	placementLabels        = "labels"
+	rejectReasonNode       = "node"
+)
+
+var (
+	cluster   clusterView
+	errNoNode = errors.New("no cluster node can place the droplet")
+)
+
+// isCluster checks whether the handler shares the work with other nodes.
+func (c *Config) isCluster() bool {
+	return c.Cluster.Enabled
+}
+
+// isValidCluster checks the validity of the cluster configuration.
+func (c *Config) isValidCluster() bool {
+	return c.Cluster.Interval >= 0 && c.Cluster.Capacity >= 0 &&
+		(c.Cluster.Placement == "" || c.Cluster.Placement == placementLeastLoaded ||
+			c.Cluster.Placement == placementAffinity || c.Cluster.Placement == placementLabels)
+}
+
+// nodeName gets the name of this node, which defaults to the hostname.
+func nodeName() string {
+	if config.Cluster.Node != "" {
+		return config.Cluster.Node
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// nodeIdentifier gets the name of this node as it is used in droplet identifiers.
+// Droplet identifiers name tmux sessions, which must not contain dots or colons.
+func nodeIdentifier() string {
+	return strings.NewReplacer(".", "_", ":", "_").Replace(nodeName())
+}
+
+// clusterInterval gets the interval the node registration is renewed in.
+func clusterInterval() time.Duration {
+	if config.Cluster.Interval != 0 {
+		return time.Duration(config.Cluster.Interval) * time.Second
+	}
+	return clusterDefaultInterval * time.Second
+}
+
+// joinCluster keeps this node registered and the view of the other nodes current.
+// A node that misses several renewals expires and is no longer considered for placement.
+func joinCluster() {
+	slog.Info("Joining cluster.", "node", nodeName())
+	for {
+		if err := registerNode(); err != nil {
+			slog.Warn("Could not register node.", "error", err)
+		} else if err = cluster.refresh(); err != nil {
+			slog.Warn("Could not refresh cluster nodes.", "error", err)
+		}
+		time.Sleep(clusterInterval())
+	}
+}
+
+// localNode describes this node with its current load.
+func localNode() *ClusterNode {
+	capacity := config.Cluster.Capacity
+	if capacity == 0 {
+		capacity = config.MemoryBudget
+	}
+	node := &ClusterNode{
+		Name:      nodeName(),
+		Labels:    config.Cluster.Labels,
+		Capacity:  capacity,
+		Templates: make([]string, 0),
+		Droplets:  make([]string, 0),
+		Instances: make(map[string]int),
+		Warm:      make(map[string]int),
+	}
+	for _, template := range templates.all() {
+		node.Templates = append(node.Templates, template.Name)
+	}
+	droplets.forAllDroplets(func(droplet *droplet) {
+		node.Used += droplet.template.MaxMemory
+		node.Droplets = append(node.Droplets, droplet.identifier)
+		node.Instances[droplet.template.Name]++
+		if droplet.isWarm() && droplet.isCurrent() {
+			node.Warm[droplet.template.Name]++
+		}
+	})
+	return node
+}
+
+// registerNode publishes this node with an expiry of several renewal intervals.
+func registerNode() error {
+	node := localNode()
+	bytes, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	expiry := clusterInterval() * clusterMissedBeats
+	if _, err = conns.do("SET", clusterNodePrefix+node.Name, bytes, "PX", expiry.Milliseconds()); err != nil {
+		return err
+	}
+	_, err = conns.do("SADD", clusterNodesKey, node.Name)
+	return err
+}
+
+// leaveCluster removes the registration of this node.
+func leaveCluster() {
+	name := nodeName()
+	if _, err := conns.do("DEL", clusterNodePrefix+name); err != nil {
+		slog.Warn("Could not unregister node.", "error", err)
+		return
+	}
+	conns.do("SREM", clusterNodesKey, name)
+}
+
+// refresh loads all registered nodes, forgetting the expired ones.
+func (c *clusterView) refresh() error {
+	names, err := redis.Strings(conns.do("SMEMBERS", clusterNodesKey))
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	keys := make([]interface{}, len(names))
+	for i, name := range names {
+		keys[i] = clusterNodePrefix + name
+	}
+	values, err := redis.ByteSlices(conns.do("MGET", keys...))
+	if err != nil {
+		return err
+	}
+	nodes := make([]*ClusterNode, 0, len(values))
+	for i, value := range values {
+		if value == nil {
+			slog.Info("Cluster node expired.", "node", names[i])
+			conns.do("SREM", clusterNodesKey, names[i])
+			continue
+		}
+		var node ClusterNode
+		if err = json.Unmarshal(value, &node); err != nil {
+			slog.Warn("Could not unmarshal cluster node.", "node", names[i], "error", err)
+			continue
+		}
+		nodes = append(nodes, &node)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nodes = nodes
+	return nil
+}
+
+// count gets the amount of registered nodes.
+func (c *clusterView) count() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.nodes)
+}
+
+// instances counts the droplets of the template on all nodes, or only the unassigned warm ones.
+func (c *clusterView) instances(template string, warm bool) int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	count := 0
+	for _, node := range c.nodes {
+		if warm {
+			count += node.Warm[template]
+		} else {
+			count += node.Instances[template]
+		}
+	}
+	return count
+}
+
+// owner gets the name of the node running the droplet, or an empty string if no node does.
+func (c *clusterView) owner(identifier string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, node := range c.nodes {
+		if contains(node.Droplets, identifier) {
+			return node.Name
+		}
+	}
+	return ""
+}
+
+// place picks the node to create a droplet of the template on according to the placement policy.
+// Every policy only considers nodes that provide the template and have capacity left, preferring the least loaded.
+func (c *clusterView) place(name string) string {
+	template := templates.get(name)
+	c.mutex.RLock()
+	candidates := make([]*ClusterNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if contains(node.Templates, name) && (template == nil || node.fits(template)) {
+			candidates = append(candidates, node)
+		}
+	}
+	c.mutex.RUnlock()
+	if template != nil {
+		switch config.Cluster.Placement {
+		case placementAffinity:
+			if preferred := filterNodes(candidates, func(node *ClusterNode) bool {
+				return contains(template.Nodes, node.Name)
+			}); len(preferred) > 0 {
+				candidates = preferred
+			}
+		case placementLabels:
+			candidates = filterNodes(candidates, func(node *ClusterNode) bool {
+				for key, value := range template.Labels {
+					if node.Labels[key] != value {
+						return false
+					}
+				}
+				return true
+			})
+		}
+	}
+	if len(candidates) == 0 {
+		return clusterNoNode
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if free, other := candidates[i].free(), candidates[j].free(); free != other {
+			return free > other
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0].Name
+}
+
+// fits checks whether the node has the capacity for a droplet of the template.
+func (n *ClusterNode) fits(template *Template) bool {
+	return n.Capacity == 0 || n.Used+template.MaxMemory <= n.Capacity
+}
+
+// free gets the memory left on the node. Nodes without capacity are never full.
+func (n *ClusterNode) free() int {
+	if n.Capacity == 0 {
+		return math.MaxInt32 - n.Used
+	}
+	return n.Capacity - n.Used
+}
+
+// filterNodes gets the nodes matching the filter.
+func filterNodes(nodes []*ClusterNode, filter func(*ClusterNode) bool) []*ClusterNode {
+	filtered := make([]*ClusterNode, 0, len(nodes))
+	for _, node := range nodes {
+		if filter(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// claimPayload decides which node handles a payload every node received.
+// The first node to claim it stores its choice, which every other node then follows.
+// Identical payloads are taken for the same request until the claim expires, so proxies should set correlation IDs.
+func claimPayload(payload *Payload, choice string) (string, bool, error) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", false, err
+	}
+	digest := sha256.Sum256(bytes)
+	key := clusterClaimPrefix + hex.EncodeToString(digest[:])
+	reply, err := conns.do("SET", key, choice, "NX", "PX", clusterClaimTTL.Milliseconds())
+	if err != nil {
+		return "", false, err
+	}
+	if reply != nil {
+		return choice, true, nil
+	}
+	claimed, err := redis.String(conns.do("GET", key))
+	return claimed, false, err
+}
+
+// isForeign checks whether the payload was sent by a droplet of another node, which handles it instead.
+func isForeign(payload *Payload) bool {
+	return (payload.Action == payloadActionIdentify || payload.Action == payloadActionHeartbeat) &&
+		!droplets.contains(payload.Sender)
+}
+
+// payloadPlaced checks whether this node creates the droplet of the request.
+// If no node can, the node that claimed the request rejects it.
+func payloadPlaced(payload *Payload, data *PayloadCreateData) bool {
+	placed, claimed, err := claimPayload(payload, cluster.place(data.Template))
+	if err != nil {
+		slog.Error("Could not claim create request.", "template", data.Template, "error", err)
+		return false
+	}
+	if placed == clusterNoNode && claimed {
+		slog.Warn("Refusing to create droplet.", "template", data.Template, "reason", rejectReasonNode)
+		payloadCreated(payload, data, nil, errNoNode)
+	}
+	if placed != nodeName() {
+		slog.Debug("Create request placed on another node.", "template", data.Template, "node", placed)
+		return false
+	}
+	return true
+}
+
+// clusterReports checks whether this node answers a request for a droplet it does not run.
+// Droplets of other nodes are left to them, unknown droplets are reported by the node that claimed the request.
+func clusterReports(payload *Payload, identifier string) bool {
+	if cluster.owner(identifier) != "" {
+		return false
+	}
+	_, claimed, err := claimPayload(payload, nodeName())
+	return err == nil && claimed
+}
+
+// clusterCreate creates the droplet the leader placed on this node.
+func clusterCreate(payload *Payload, delivery *delivery) {
+	var data PayloadCreateData
+	if err := json.Unmarshal(payload.Data, &data); err != nil || data.Node != nodeName() {
+		return
+	}
+	if err := verifyPayload(payload, delivery.received); err != nil {
+		slog.Warn("Ignoring, placed create not authenticated.", "template", data.Template, "error", err)
+		return
+	}
+	if isShuttingDown() {
+		return
+	}
+	template := templates.get(data.Template)
+	if template == nil {
+		slog.Warn("Leader placed droplet of unknown template.", "template", data.Template)
+		return
+	}
+	delivery.hold()
+	go func() {
+		defer delivery.release()
+		if err := template.launchLocal(data.Warm); err != nil {
+			slog.Error("Error creating placed droplet.", "template", template.Name, "error", err)
+		}
+	}()
+}
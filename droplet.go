@@ -2,31 +2,104 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"os/exec"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultStopGrace   = 15
+	defaultStopTimeout = 30
+	stopPollInterval   = 1 * time.Second
+)
+
+var (
+	defaultStopCommands = []string{"save-all", "stop"}
+)
+
+// createDroplet claims a warm droplet of the template, or launches a new one if none is available.
+func createDroplet(template *Template, data string) (*droplet, error) {
+	if isShuttingDown() {
+		return nil, errShuttingDown
+	}
+	droplet := droplets.claim(template)
+	if droplet == nil {
+		return template.launch(data)
+	}
+	err := droplet.assign(data)
+	if err != nil {
+		droplet.logger().Error("Could not assign warm droplet.", "error", err)
+	}
+	if config.isCluster() {
+		// The leader tops up the warm pools of the whole cluster.
+		return droplet, nil
+	}
+	go func() {
+		_, err := template.launchWarm()
+		if err != nil {
+			slog.Error("Error replacing warm droplet.", "template", template.Name, "error", err)
+		}
+	}()
+	return droplet, nil
+}
+
+// launch creates and boots a new droplet, deleting it again if it does not identify in time.
+func (t *Template) launch(data string) (*droplet, error) {
+	return t.start(data, false)
+}
+
+// launchWarm launches a droplet that waits in the warm pool until it is claimed.
+func (t *Template) launchWarm() (*droplet, error) {
+	return t.start("", true)
+}
+
+// start creates and boots a droplet, deleting it again if it fails to boot or does not identify in time.
+func (t *Template) start(data string, warm bool) (*droplet, error) {
+	droplet, err := t.create(data, warm)
+	if err != nil {
+		return nil, err
+	}
+	droplet.logger().Info("Successfully created droplet.", "warm", warm)
+	droplet.logger().Info("Attempting to boot droplet.")
+	err = droplet.boot()
+	if err != nil {
+		droplet.logger().Error("Error booting droplet.", "error", err)
+		droplet.kill()
+		return nil, err
+	}
+	go droplet.awaitIdentify()
+	persistState()
+	return droplet, nil
+}
+
 // create creates a new droplet.
-func (t *Template) create(data string) (drop *droplet, err error) {
-	log.Printf("Starting the generation of a droplet of type %s.\n", t.Name)
-	identifier := generateDropletIdentifier(t.Name)
+func (t *Template) create(data string, warm bool) (drop *droplet, err error) {
+	slog.Info("Starting the generation of a droplet.", "template", t.Name)
+	defer metricCreateDuration.observeSince(time.Now(), t.Name)
+	drop, err = droplets.reserve(t, warm)
+	if err != nil {
+		return nil, err
+	}
+	identifier := drop.identifier
+	defer func() {
+		if err != nil {
+			droplets.remove(identifier)
+			drop = nil
+		}
+	}()
 	port, err := getFreePort()
 	if err != nil {
-		log.Println("Obtaining free port error.")
+		drop.logger().Error("Obtaining free port error.", "error", err)
 		return
 	}
 	address := getOutboundAddress()
-	log.Printf("Using outbound IP address %s.\n", address)
-	log.Printf("Using free port %d.\n", port)
-	drop = &droplet{
-		identifier: identifier,
-		ip:         address,
-		port:       port,
-		template:   t,
-		iid:        atomic.AddUint64(&internalDropletHandlerID, 1),
-	}
+	drop.logger().Info("Using outbound address.", "ip", address, "port", port)
+	drop.mutex.Lock()
+	drop.ip = address
+	drop.port = port
+	drop.data = data
+	drop.mutex.Unlock()
 	deleteTerminal(identifier)
 	target := targetPath(identifier, "")
 	template := templatePath(t.Name, "")
@@ -50,28 +123,76 @@ func (t *Template) create(data string) (drop *droplet, err error) {
 			template.handler(path, address, port)
 		}
 	}
-	droplets.put(identifier, drop)
 	return
 }
 
 // boot boots a droplet.
+// It is only marked as booting once the boot script created its terminal, so the supervisor does not take it for crashed before.
 func (d *droplet) boot() error {
-	if !droplets.contains(d.identifier) {
+	state := d.getState()
+	if !droplets.contains(d.identifier) || state == dropletStateDeleting {
 		return errDropletDeleted
 	}
+	defer metricBootDuration.observeSince(time.Now(), d.template.Name)
 	path := targetPath(d.identifier, "boot.sh")
 	err := execute("chmod", "+x", path)
 	err = executeSpecial(func(cmd *exec.Cmd) {
 		cmd.Dir = targetPath(d.identifier, "")
 	}, path)
+	if err == nil {
+		// Keep the pane after the process exits so the supervisor can read the exit status.
+		execute("tmux", "set-option", "-t", d.identifier, "remain-on-exit", "on")
+		d.transition(state, dropletStateBooting)
+	}
 	return err
 }
 
+// awaitIdentify deletes the droplet if it has not identified itself after 2 minutes.
+func (d *droplet) awaitIdentify() {
+	restarts := atomic.LoadInt32(&d.restarts)
+	time.Sleep(2 * time.Minute)
+	current := droplets.get(d.identifier)
+	if current != nil && current.getState() == dropletStateBooting && current.iid == d.iid && atomic.LoadInt32(&current.restarts) == restarts {
+		d.logger().Warn("Received no identify from droplet in 2 minutes, starting delete.")
+		metricIdentifyTimeouts.inc(d.template.Name)
+		current.delete(true)
+	}
+}
+
+// getState gets the state of the droplet.
+func (d *droplet) getState() int32 {
+	return atomic.LoadInt32(&d.state)
+}
+
+// setState sets the state of the droplet, unless it is being deleted.
+func (d *droplet) setState(state int32) {
+	for {
+		current := atomic.LoadInt32(&d.state)
+		if current == dropletStateDeleting || atomic.CompareAndSwapInt32(&d.state, current, state) {
+			return
+		}
+	}
+}
+
+// transition changes the state of the droplet only if it currently is in the expected state.
+func (d *droplet) transition(from, to int32) bool {
+	return atomic.CompareAndSwapInt32(&d.state, from, to)
+}
+
+// isIdentified checks whether the droplet is running and has identified itself.
+func (d *droplet) isIdentified() bool {
+	return d.getState() == dropletStateIdentified
+}
+
 // delete deletes a droplet.
 func (d *droplet) delete(payload bool) error {
 	if !droplets.contains(d.identifier) {
 		return errDropletDeleted
 	}
+	if atomic.SwapInt32(&d.state, dropletStateDeleting) == dropletStateDeleting {
+		return errDropletDeleted
+	}
+	defer metricDeleteDuration.observeSince(time.Now(), d.template.Name)
 	if payload {
 		data, err := json.Marshal(d.toPayloadEntity())
 		if err != nil {
@@ -81,23 +202,102 @@ func (d *droplet) delete(payload bool) error {
 			Action: payloadActionDelete,
 			Sender: payloadSenderHandler,
 			Data:   data,
-			Token:  config.Token,
 		})
 	}
-	log.Printf("Deleting droplet %s in 15 seconds.\n", d.identifier)
-	time.Sleep(15 * time.Second)
-	deleteTerminal(d.identifier)
+	grace := d.template.stopGrace()
+	d.logger().Info("Deleting droplet after grace period.", "grace", grace)
+	time.Sleep(grace)
+	d.stop()
 	droplets.remove(d.identifier)
+	persistState()
 	err := deleteExists(targetPath(d.identifier, ""))
 	if err != nil {
 		return err
 	}
-	log.Printf("Deleted droplet %s.\n", d.identifier)
+	d.logger().Info("Deleted droplet.")
+	return nil
+}
+
+// stop sends the stop commands of the template to the console and waits for the process to exit.
+// The terminal is killed once the process exited, or when it did not within the stop timeout.
+func (d *droplet) stop() {
+	for _, command := range d.template.stopCommands() {
+		if err := sendTerminal(d.identifier, command); err != nil {
+			d.logger().Warn("Could not send stop command.", "command", command, "error", err)
+			break
+		}
+	}
+	deadline := time.Now().Add(d.template.stopTimeout())
+	running, _ := terminalStatus(d.identifier)
+	for running && time.Now().Before(deadline) {
+		time.Sleep(stopPollInterval)
+		running, _ = terminalStatus(d.identifier)
+	}
+	if running {
+		d.logger().Warn("Droplet did not stop in time, killing it.", "timeout", d.template.stopTimeout())
+	}
+	deleteTerminal(d.identifier)
+}
+
+// stopCommands gets the console commands that stop a droplet of the template.
+// Without any configured, the world is saved and the server stopped.
+func (t *Template) stopCommands() []string {
+	if t.StopCommands == nil {
+		return defaultStopCommands
+	}
+	return t.StopCommands
+}
+
+// stopGrace gets the time a droplet of the template keeps running after its deletion is announced.
+func (t *Template) stopGrace() time.Duration {
+	if t.StopGrace != 0 {
+		return time.Duration(t.StopGrace) * time.Second
+	}
+	return defaultStopGrace * time.Second
+}
+
+// stopTimeout gets the time a droplet of the template is given to exit after the stop commands.
+func (t *Template) stopTimeout() time.Duration {
+	if t.StopTimeout != 0 {
+		return time.Duration(t.StopTimeout) * time.Second
+	}
+	return defaultStopTimeout * time.Second
+}
+
+// kill removes the droplet at once, without giving it time to stop.
+func (d *droplet) kill() {
+	atomic.StoreInt32(&d.state, dropletStateDeleting)
+	deleteTerminal(d.identifier)
+	droplets.remove(d.identifier)
+	if err := deleteExists(targetPath(d.identifier, "")); err != nil {
+		d.logger().Warn("Could not delete files of killed droplet.", "error", err)
+	}
+	d.logger().Warn("Killed droplet.")
+}
+
+// assign hands the data of a create request over to a claimed warm droplet.
+func (d *droplet) assign(data string) error {
+	d.mutex.Lock()
+	d.data = data
+	d.mutex.Unlock()
+	bytes, err := json.Marshal(d.toPayloadEntity())
+	if err != nil {
+		return err
+	}
+	payloadSend(&Payload{
+		Action: payloadActionAssign,
+		Sender: payloadSenderHandler,
+		Data:   bytes,
+	})
+	persistState()
+	d.logger().Info("Assigned warm droplet.")
 	return nil
 }
 
 // toPayloadEntity converts the droplet to a payload entity.
 func (d *droplet) toPayloadEntity() *PayloadDroplet {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return &PayloadDroplet{
 		Identifier: d.identifier,
 		IP:         d.ip,
@@ -105,3 +305,25 @@ func (d *droplet) toPayloadEntity() *PayloadDroplet {
 		Data:       d.data,
 	}
 }
+
+// isCurrent checks whether the droplet was created from the registered definition of its template.
+// Droplets of templates that were changed or removed by a reload are not.
+func (d *droplet) isCurrent() bool {
+	return templates.get(d.template.Name) == d.template
+}
+
+// isWarm checks whether the droplet waits in the warm pool.
+func (d *droplet) isWarm() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.warm
+}
+
+// unwarm takes the droplet out of the warm pool, reporting whether it was in it.
+func (d *droplet) unwarm() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	warm := d.warm
+	d.warm = false
+	return warm
+}
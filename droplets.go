@@ -4,18 +4,30 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type (
 	// Template represents a droplet template.
 	Template struct {
-		Name      string `json:"name"`
-		MinMemory int    `json:"min-memory"`
-		MaxMemory int    `json:"max-memory"`
+		Name           string            `json:"name"`
+		MinMemory      int               `json:"min-memory"`
+		MaxMemory      int               `json:"max-memory"`
+		MinInstances   int               `json:"min-instances"`
+		MaxInstances   int               `json:"max-instances"`
+		WarmPool       int               `json:"warm-pool"`
+		RestartPolicy  string            `json:"restart-policy"`
+		MaxRetries     int               `json:"max-retries"`
+		RestartBackoff int               `json:"restart-backoff"`
+		StopCommands   []string          `json:"stop-commands"`
+		StopGrace      int               `json:"stop-grace"`
+		StopTimeout    int               `json:"stop-timeout"`
+		Nodes          []string          `json:"nodes"`
+		Labels         map[string]string `json:"labels"`
 	}
 	dropletMap struct {
 		droplets map[string]*droplet
@@ -27,7 +39,15 @@ type (
 		port       int
 		data       string
 		template   *Template
-		identified bool
+		state      int32
+		warm       bool
+		restarts   int32
+		retries    int32
+		lastSeen   int64
+		tps        float64
+		players    int
+		mutex      sync.Mutex
+		created    time.Time
 		iid        uint64
 	}
 	dropletFile struct {
@@ -39,15 +59,26 @@ type (
 )
 
 const (
-	pluginName       = "Droplets"
-	statusOnline     = "online"
-	statusOffline    = "offline"
-	handlerUIDBoot   = 1
-	handlerUIDLogs   = 2
-	handlerUIDConfig = 3
-	handlerUIDServer = 4
-	filePlugins      = "plugins/"
-	fileSpigot       = "spigot.jar"
+	pluginName             = "Droplets"
+	statusOnline           = "online"
+	statusOffline          = "offline"
+	handlerUIDBoot         = 1
+	handlerUIDLogs         = 2
+	handlerUIDConfig       = 3
+	handlerUIDServer       = 4
+	filePlugins            = "plugins/"
+	fileSpigot             = "spigot.jar"
+	restartPolicyNever     = "never"
+	restartPolicyOnFailure = "on-failure"
+	restartPolicyAlways    = "always"
+)
+
+const (
+	dropletStateCreated int32 = iota
+	dropletStateBooting
+	dropletStateIdentified
+	dropletStateCrashed
+	dropletStateDeleting
 )
 
 var (
@@ -60,8 +91,8 @@ var (
 			name:     "boot.sh",
 			required: true,
 			handler: func(path string, args ...interface{}) {
-				if len(args) < 2 {
-					log.Println("Expected 2 arguments, found none.")
+				if len(args) < 3 {
+					slog.Error("Expected 3 arguments for boot script.", "path", path, "found", len(args))
 					return
 				}
 				identifier := args[0].(string)
@@ -69,7 +100,7 @@ var (
 				template := args[2].(*Template)
 				bytes, err := ioutil.ReadFile(path)
 				if err != nil {
-					log.Printf("Could not edit file %s: %s.\n", path, err.Error())
+					slog.Error("Could not edit file.", "path", path, "error", err)
 					return
 				}
 				str := string(bytes)
@@ -93,13 +124,14 @@ var (
 					bootVariable{
 						placeholder: "DATA",
 						value:       data,
+						sensitive:   true,
 					},
 				}
+				slog.Debug("Modified boot script.", "path", path, "script", replaceAll(str, redactVariables(variables)...))
 				str = replaceAll(str, variables...)
-				log.Printf("Modified boot script: %s.\n", str)
 				err = ioutil.WriteFile(path, []byte(str), 0644)
 				if err != nil {
-					log.Printf("Could not save file %s: %s.\n", path, err.Error())
+					slog.Error("Could not save file.", "path", path, "error", err)
 				}
 			},
 			handlerUID: handlerUIDBoot,
@@ -110,7 +142,7 @@ var (
 			handler: func(path string, args ...interface{}) {
 				err := os.RemoveAll(path)
 				if err != nil {
-					log.Printf("Could not delete %s directory: %s.\n", path, err.Error())
+					slog.Error("Could not delete directory.", "path", path, "error", err)
 				}
 			},
 			handlerUID: handlerUIDLogs,
@@ -132,16 +164,19 @@ var (
 				var dataMap map[string]interface{}
 				err := loadData(path, &dataMap)
 				if err != nil {
-					log.Printf("Could not load config %s.\n", path)
+					slog.Error("Could not load config.", "path", path, "error", err)
 					return
 				}
 				dataMap["identifier"] = identifier
 				if data != "" {
 					dataMap["data"] = data
 				}
+				if secret := dropletSecret(identifier); secret != "" {
+					dataMap["secret"] = secret
+				}
 				err = saveData(path, &dataMap)
 				if err != nil {
-					log.Printf("Could not save config %s.\n", path)
+					slog.Error("Could not save config.", "path", path, "error", err)
 				}
 			},
 			handlerUID: handlerUIDConfig,
@@ -154,14 +189,14 @@ var (
 				port := args[1].(int)
 				contents, err := ioutil.ReadFile(path)
 				if err != nil {
-					log.Printf("Could not read %s: %s.\n", path, err.Error())
+					slog.Error("Could not read file.", "path", path, "error", err)
 					return
 				}
 				contents = bytes.Replace(contents, []byte("IP"), []byte(ip), -1)
 				contents = bytes.Replace(contents, []byte("PORT"), []byte(strconv.Itoa(port)), -1)
 				err = ioutil.WriteFile(path, contents, 0644)
 				if err != nil {
-					log.Printf("Could not write %s: %s.\n", path, err.Error())
+					slog.Error("Could not write file.", "path", path, "error", err)
 				}
 			},
 			handlerUID: handlerUIDServer,
@@ -171,12 +206,24 @@ var (
 			required: true,
 		},
 	}
+	dropletStateNames = map[int32]string{
+		dropletStateCreated:    "created",
+		dropletStateBooting:    "booting",
+		dropletStateIdentified: "identified",
+		dropletStateCrashed:    "crashed",
+		dropletStateDeleting:   "deleting",
+	}
 	errDropletDeleted = errors.New("droplet no longer exists")
+	errInstanceLimit  = errors.New("template instance limit reached")
+	errMemoryBudget   = errors.New("host memory budget exceeded")
 )
 
 // isValid checks the validity of a template.
 func (t *Template) isValid() bool {
-	return t.Name != "" && t.MinMemory > 0 && t.MaxMemory > 0 && t.MinMemory <= t.MaxMemory
+	return t.Name != "" && t.MinMemory > 0 && t.MaxMemory > 0 && t.MinMemory <= t.MaxMemory &&
+		t.MinInstances >= 0 && t.MaxInstances >= 0 && (t.MaxInstances == 0 || t.MinInstances <= t.MaxInstances) &&
+		t.WarmPool >= 0 && t.MaxRetries >= 0 && t.RestartBackoff >= 0 && t.StopGrace >= 0 && t.StopTimeout >= 0 &&
+		(t.RestartPolicy == "" || t.RestartPolicy == restartPolicyNever || t.RestartPolicy == restartPolicyOnFailure || t.RestartPolicy == restartPolicyAlways)
 }
 
 // containsFiles checks if the template contains all required files.
@@ -185,7 +232,7 @@ func (t *Template) containsFiles() bool {
 		requiredFile := &requiredFiles[i]
 		path := templatePath(t.Name, requiredFile.name)
 		if !fileExists(path) && requiredFile.required {
-			log.Printf("Missing file %s for template %s.\n", path, t.Name)
+			slog.Warn("Missing file for template.", "path", path, "template", t.Name)
 			return false
 		}
 	}
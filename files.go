@@ -11,6 +11,7 @@ type (
 	bootVariable struct {
 		placeholder string
 		value       string
+		sensitive   bool
 	}
 )
 
@@ -60,6 +61,18 @@ func deleteExists(path string) (err error) {
 	return
 }
 
+// redactVariables hides the values of sensitive variables, so the result can be logged.
+func redactVariables(vars []bootVariable) []bootVariable {
+	redacted := make([]bootVariable, len(vars))
+	for i, variable := range vars {
+		redacted[i] = variable
+		if variable.sensitive {
+			redacted[i].value = "[REDACTED]"
+		}
+	}
+	return redacted
+}
+
 // replacecAll replaces all variables
 func replaceAll(input string, vars ...bootVariable) string {
 	for _, variable := range vars {
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -14,93 +17,187 @@ type (
 	// Config represents the main config file.
 	Config struct {
 		Redis struct {
-			Host     string `json:"host"`
-			Port     int    `json:"port"`
-			Auth     string `json:"auth"`
-			Database int    `json:"database"`
+			Host         string `json:"host"`
+			Port         int    `json:"port"`
+			Socket       string `json:"socket"`
+			Username     string `json:"username"`
+			Auth         string `json:"auth"`
+			Database     int    `json:"database"`
+			MaxIdle      int    `json:"max-idle"`
+			MaxActive    int    `json:"max-active"`
+			DialTimeout  int    `json:"dial-timeout"`
+			ReadTimeout  int    `json:"read-timeout"`
+			WriteTimeout int    `json:"write-timeout"`
+			Sentinel     struct {
+				Master    string   `json:"master"`
+				Addresses []string `json:"addresses"`
+				Username  string   `json:"username"`
+				Auth      string   `json:"auth"`
+			} `json:"sentinel"`
+			TLS struct {
+				Enabled    bool   `json:"enabled"`
+				CAFile     string `json:"ca-file"`
+				CertFile   string `json:"cert-file"`
+				KeyFile    string `json:"key-file"`
+				ServerName string `json:"server-name"`
+				SkipVerify bool   `json:"skip-verify"`
+			} `json:"tls"`
 		} `json:"redis"`
-		TemplatesDir string `json:"templates-dir"`
-		TargetDir    string `json:"target-dir"`
-		Token        string `json:"token"`
+		Heartbeat struct {
+			Interval int    `json:"interval"`
+			Missed   int    `json:"missed"`
+			Action   string `json:"action"`
+		} `json:"heartbeat"`
+		Transport struct {
+			Type      string `json:"type"`
+			Stream    string `json:"stream"`
+			Group     string `json:"group"`
+			Consumer  string `json:"consumer"`
+			MaxLength int    `json:"max-length"`
+			ClaimIdle int    `json:"claim-idle"`
+		} `json:"transport"`
+		Signing struct {
+			Window  int                      `json:"window"`
+			Senders map[string]*SenderConfig `json:"senders"`
+		} `json:"signing"`
+		ACL     map[string]*ACLRule `json:"acl"`
+		Cluster struct {
+			Enabled   bool              `json:"enabled"`
+			Node      string            `json:"node"`
+			Labels    map[string]string `json:"labels"`
+			Capacity  int               `json:"capacity"`
+			Placement string            `json:"placement"`
+			Interval  int               `json:"interval"`
+		} `json:"cluster"`
+		Admin struct {
+			Address string `json:"address"`
+			Token   string `json:"token"`
+		} `json:"admin"`
+		Metrics struct {
+			Address string `json:"address"`
+		} `json:"metrics"`
+		Log struct {
+			Format string `json:"format"`
+			Level  string `json:"level"`
+		} `json:"log"`
+		TemplatesDir   string `json:"templates-dir"`
+		TemplatesWatch int    `json:"templates-watch"`
+		TargetDir      string `json:"target-dir"`
+		Token          string `json:"token"`
+		MemoryBudget   int    `json:"memory-budget"`
+		StateFile      string `json:"state-file"`
+		LockFile       string `json:"lock-file"`
+		Detach         bool   `json:"detach-on-shutdown"`
+		Shutdown       int    `json:"shutdown-timeout"`
 	}
 )
 
 const (
-	configFile   = "config.json"
-	templateFile = "template.json"
-	lockFile     = "droplets.lock"
+	forceUnlock            = "--force-unlock"
+	configFile             = "config.json"
+	templateFile           = "template.json"
+	lockFile               = "droplets.lock"
+	stateFile              = "droplets.state"
+	defaultShutdownTimeout = 1 * time.Minute
 )
 
 var (
-	config    Config
-	templates = make([]*Template, 0)
+	config          Config
+	templates       templateList
+	shuttingDown    int32
+	errShuttingDown = errors.New("handler is shutting down")
 )
 
 // main is the entry point of the program.
+// Without arguments the handler is started, otherwise a client subcommand is run.
+// The handler may be started with --force-unlock to remove the lock of another handler.
 func main() {
-	log.Println("Checking OS compatibility...")
-	if runtime.GOOS != "linux" {
-		log.Println("Droplets unable to run on non-linux operating systems.")
-		return
+	force := len(os.Args) == 2 && os.Args[1] == forceUnlock
+	if len(os.Args) > 1 && !force {
+		os.Exit(runClient(os.Args[1:]))
 	}
-	log.Println("Operating system compatible. #LinuxMasterrace.")
-	if !initiateLock() {
-		log.Println("Droplet lock already exists, perhaps another handler is running?")
+	slog.Info("Checking OS compatibility...")
+	if runtime.GOOS != "linux" {
+		slog.Error("Droplets unable to run on non-linux operating systems.")
 		return
 	}
-	log.Println("Loading configuration...")
+	slog.Info("Operating system compatible. #LinuxMasterrace.")
+	slog.Info("Loading configuration...")
 	err := loadData(configFile, &config)
 	if err != nil {
 		panic(err)
 	}
 	if !config.isValid() {
-		log.Println("Configuration is invalid.")
+		slog.Error("Configuration is invalid.")
 		return
 	}
 	config.handleDirs()
-	log.Println("Loaded configuration.")
-	log.Println("Loading templates...")
-	var localTemplates []*Template
-	err = loadData(templateFile, &localTemplates)
+	if err = initiateLock(force); err != nil {
+		slog.Error("Could not acquire droplet lock, perhaps another handler is running?", "error", err)
+		return
+	}
+	setupLogging()
+	slog.Info("Loaded configuration.")
+	slog.Info("Loading templates...")
+	localTemplates, err := loadTemplates()
 	if err != nil {
 		panic(err)
 	}
-	for _, template := range localTemplates {
-		if template.isValid() {
-			if template.containsFiles() {
-				log.Printf("Registered template %s.\n", template.Name)
-				templates = append(templates, template)
-			} else {
-				log.Printf("Template %s does not contain all required files.\n", template.Name)
-			}
-		} else {
-			log.Printf("Template %s is invalid.\n", template.Name)
-		}
+	templates.replace(localTemplates)
+	slog.Info("Template loading completed.")
+	if config.TemplatesWatch > 0 {
+		slog.Info("Watching templates for changes.", "interval", config.TemplatesWatch)
+		go watchTemplates(time.Duration(config.TemplatesWatch) * time.Second)
 	}
-	log.Println("Template loading completed.")
-	log.Println("Connecting to Redis...")
-	err = connectRedis()
-	if err != nil {
-		panic(err)
+	slog.Info("Recovering droplets...")
+	recoverState()
+	slog.Info("Droplet recovery completed.")
+	slog.Info("Connecting to Redis...")
+	connectRedis()
+	if config.isCluster() {
+		go joinCluster()
+		go electLeader()
+	}
+	go maintainInstances()
+	go superviseDroplets()
+	if config.Admin.Address != "" {
+		go listenAdmin()
+	}
+	if config.Metrics.Address != "" {
+		go listenMetrics()
 	}
-	go payloadReceive()
 	go func() {
 		for {
 			time.Sleep(1 * time.Minute)
 			droplets.forAllDroplets(func(droplet *droplet) {
-				log.Printf("Reported registered droplet %s (identified: %t).\n", droplet.identifier, droplet.identified)
+				droplet.logger().Info("Reported registered droplet.", "state", dropletStateNames[droplet.getState()])
 			})
 		}
 	}()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadTemplates()
+		}
+	}()
 	keepalive := make(chan os.Signal, 1)
 	signal.Notify(keepalive, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 	<-keepalive
-	terminate()
+	terminate(keepalive)
 }
 
 // isValid checks the validity of a config.
 func (c *Config) isValid() bool {
-	return c.Redis.Host != "" && c.Redis.Port != 0 && c.TemplatesDir != "" && c.TargetDir != "" && c.Token != ""
+	return ((c.Redis.Host != "" && c.Redis.Port != 0) || c.Redis.Socket != "" || (c.isSentinel() && len(c.Redis.Sentinel.Addresses) > 0)) &&
+		c.TemplatesDir != "" && c.TargetDir != "" && c.isValidSigning() && c.isValidACL() && c.isValidCluster() && c.Shutdown >= 0 &&
+		(c.Redis.TLS.CertFile == "") == (c.Redis.TLS.KeyFile == "") &&
+		c.Redis.MaxIdle >= 0 && c.Redis.MaxActive >= 0 && c.Redis.DialTimeout >= 0 && c.Redis.ReadTimeout >= 0 && c.Redis.WriteTimeout >= 0 &&
+		(c.Transport.Type == "" || c.Transport.Type == transportPubSub || c.Transport.Type == transportStreams) &&
+		c.Transport.MaxLength >= 0 && c.Transport.ClaimIdle >= 0 &&
+		(c.Admin.Address == "" || c.Admin.Token != "") && c.isValidLog() &&
+		c.Heartbeat.Interval >= 0 && c.Heartbeat.Missed >= 0 &&
+		(c.Heartbeat.Action == "" || c.Heartbeat.Action == heartbeatActionDelete || c.Heartbeat.Action == heartbeatActionRestart)
 }
 
 // handleDirs appends the directory separator to path variables.
@@ -114,11 +211,74 @@ func (c *Config) toRedisString() string {
 	return c.Redis.Host + ":" + strconv.Itoa(c.Redis.Port)
 }
 
-// terminate terminates everything.
-func terminate() {
-	droplets.forAllDroplets(func(droplet *droplet) {
-		droplet.delete(true)
-	})
+// terminate terminates everything. Droplets are left running if the handler is configured to detach.
+// Another signal stops the handler at once, killing the droplets still running.
+func terminate(signals <-chan os.Signal) {
+	// No droplets are created or restarted from now on, so the droplets drained are all there are.
+	atomic.StoreInt32(&shuttingDown, 1)
+	flush := queueFlush
+	if config.Detach {
+		slog.Info("Detaching from running droplets.")
+		persistState()
+	} else if !drainDroplets(signals) {
+		flush = 0
+	}
+	outbound.flush(flush)
+	outbound.close()
+	if config.isCluster() {
+		resignLeader()
+		leaveCluster()
+	}
 	conns.close()
 	removeLock()
 }
+
+// isShuttingDown checks whether the handler is shutting down.
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// drainDroplets deletes all droplets in parallel and kills the ones left at the shutdown deadline.
+// It reports whether the droplets were drained without being interrupted by another signal.
+func drainDroplets(signals <-chan os.Signal) bool {
+	var group sync.WaitGroup
+	droplets.forAllDroplets(func(droplet *droplet) {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			droplet.delete(true)
+		}()
+	})
+	drained := make(chan struct{})
+	go func() {
+		group.Wait()
+		// Droplets deleted concurrently, e.g. after crashing, are still being removed.
+		for droplets.size() > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		close(drained)
+	}()
+	graceful := true
+	select {
+	case <-drained:
+		return true
+	case <-time.After(shutdownTimeout()):
+		slog.Warn("Shutdown deadline passed, killing remaining droplets.")
+	case <-signals:
+		slog.Warn("Received another signal, stopping immediately.")
+		graceful = false
+	}
+	droplets.forAllDroplets(func(droplet *droplet) {
+		droplet.kill()
+	})
+	persistState()
+	return graceful
+}
+
+// shutdownTimeout gets the time droplets are given to stop when the handler shuts down.
+func shutdownTimeout() time.Duration {
+	if config.Shutdown != 0 {
+		return time.Duration(config.Shutdown) * time.Second
+	}
+	return defaultShutdownTimeout
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	leaderKey     = "droplets:leader"
+	leaderTTL     = 15 * time.Second
+	leaderRenewal = 5 * time.Second
+	// leaderRenewScript extends the lease only if this node still holds it.
+	leaderRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	// leaderResignScript releases the lease only if this node still holds it.
+	leaderResignScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+var (
+	leading int32
+)
+
+// isLeader checks whether this node runs the duties of the whole cluster. Outside of cluster mode, it always does.
+func isLeader() bool {
+	return !config.isCluster() || atomic.LoadInt32(&leading) == 1
+}
+
+// electLeader campaigns for the leader lease and renews it while it is held.
+// If the leader disappears, its lease expires and another node takes over.
+func electLeader() {
+	for {
+		leader, err := campaign(atomic.LoadInt32(&leading) == 1)
+		if err != nil {
+			slog.Warn("Could not campaign for leadership.", "error", err)
+		}
+		if leader && atomic.SwapInt32(&leading, 1) == 0 {
+			slog.Info("Became cluster leader.", "node", nodeName())
+		} else if !leader && atomic.SwapInt32(&leading, 0) == 1 {
+			slog.Warn("Lost cluster leadership.", "node", nodeName())
+		}
+		time.Sleep(leaderRenewal)
+	}
+}
+
+// campaign renews the lease if this node holds it, or tries to acquire it otherwise.
+// A leader that cannot reach Redis steps down, as its lease may expire meanwhile.
+func campaign(leader bool) (bool, error) {
+	if leader {
+		renewed, err := conns.do("EVAL", leaderRenewScript, 1, leaderKey, nodeName(), leaderTTL.Milliseconds())
+		return err == nil && renewed != int64(0), err
+	}
+	acquired, err := conns.do("SET", leaderKey, nodeName(), "NX", "PX", leaderTTL.Milliseconds())
+	return err == nil && acquired != nil, err
+}
+
+// resignLeader releases the lease, so another node takes over without waiting for it to expire.
+func resignLeader() {
+	if atomic.SwapInt32(&leading, 0) == 0 {
+		return
+	}
+	if _, err := conns.do("EVAL", leaderResignScript, 1, leaderKey, nodeName()); err != nil {
+		slog.Warn("Could not resign cluster leadership.", "error", err)
+	}
+}
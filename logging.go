@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+var (
+	logLevels = map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+)
+
+// setupLogging replaces the default logger with a structured one according to the config.
+func setupLogging() {
+	options := &slog.HandlerOptions{
+		Level: logLevels[strings.ToLower(config.Log.Level)],
+	}
+	var handler slog.Handler
+	if config.Log.Format == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// isValidLog checks the validity of the logging config.
+func (c *Config) isValidLog() bool {
+	_, level := logLevels[strings.ToLower(c.Log.Level)]
+	return (c.Log.Level == "" || level) && (c.Log.Format == "" || c.Log.Format == logFormatJSON || c.Log.Format == logFormatLogfmt)
+}
+
+// logger gets a logger carrying the context of the droplet.
+func (d *droplet) logger() *slog.Logger {
+	return slog.With("identifier", d.identifier, "template", d.template.Name, "iid", d.iid)
+}
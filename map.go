@@ -1,5 +1,10 @@
 package main
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 // get gets a droplet by identifier.
 func (d *dropletMap) get(identifier string) *droplet {
 	d.mutex.Lock()
@@ -14,6 +19,53 @@ func (d *dropletMap) put(identifier string, droplet *droplet) {
 	d.droplets[identifier] = droplet
 }
 
+// reserve adds a new droplet of the template to the map, if neither the instance limit nor the memory budget is exceeded.
+func (d *dropletMap) reserve(t *Template, warm bool) (*droplet, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if isShuttingDown() {
+		return nil, errShuttingDown
+	}
+	instances, memory := 0, 0
+	for _, droplet := range d.droplets {
+		if droplet.template.Name == t.Name {
+			instances++
+		}
+		memory += droplet.template.MaxMemory
+	}
+	if t.MaxInstances > 0 && instances >= t.MaxInstances {
+		return nil, errInstanceLimit
+	}
+	if config.MemoryBudget > 0 && memory+t.MaxMemory > config.MemoryBudget {
+		return nil, errMemoryBudget
+	}
+	prefix := t.Name
+	if config.isCluster() {
+		// Identifiers of different nodes must not collide.
+		prefix += payloadSplitIdentifier + nodeIdentifier()
+	}
+	identifier := generateDropletIdentifier(prefix, func(identifier string) bool {
+		_, contains := d.droplets[identifier]
+		return contains
+	})
+	droplet := &droplet{
+		identifier: identifier,
+		template:   t,
+		warm:       warm,
+		created:    time.Now(),
+		iid:        atomic.AddUint64(&internalDropletHandlerID, 1),
+	}
+	d.droplets[identifier] = droplet
+	return droplet, nil
+}
+
+// size counts all droplets.
+func (d *dropletMap) size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.droplets)
+}
+
 // contains checks if the map contains the droplet.
 func (d *dropletMap) contains(identifier string) bool {
 	d.mutex.Lock()
@@ -22,6 +74,44 @@ func (d *dropletMap) contains(identifier string) bool {
 	return contains
 }
 
+// count counts the droplets of the template.
+func (d *dropletMap) count(template string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	count := 0
+	for _, droplet := range d.droplets {
+		if droplet.template.Name == template {
+			count++
+		}
+	}
+	return count
+}
+
+// countWarm counts the unassigned warm droplets created from the definition of the template.
+func (d *dropletMap) countWarm(template *Template) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	count := 0
+	for _, droplet := range d.droplets {
+		if droplet.template == template && droplet.isWarm() {
+			count++
+		}
+	}
+	return count
+}
+
+// claim takes an identified warm droplet created from the definition of the template out of the warm pool.
+func (d *dropletMap) claim(template *Template) *droplet {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, droplet := range d.droplets {
+		if droplet.template == template && droplet.isIdentified() && droplet.unwarm() {
+			return droplet
+		}
+	}
+	return nil
+}
+
 // remove removes a droplet.
 func (d *dropletMap) remove(identifier string) {
 	d.mutex.Lock()
@@ -29,8 +119,15 @@ func (d *dropletMap) remove(identifier string) {
 	delete(d.droplets, identifier)
 }
 
+// forAllDroplets runs the function for a snapshot of all droplets, so the function may modify the map.
 func (d *dropletMap) forAllDroplets(fn func(*droplet)) {
+	d.mutex.Lock()
+	snapshot := make([]*droplet, 0, len(d.droplets))
 	for _, droplet := range d.droplets {
+		snapshot = append(snapshot, droplet)
+	}
+	d.mutex.Unlock()
+	for _, droplet := range snapshot {
 		fn(droplet)
 	}
 }
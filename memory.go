@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryTransport delivers payloads between subscribers in the same process.
+	// It is meant for running the payload flow without Redis, e.g. in tests.
+	memoryTransport struct {
+		subscribers []chan []byte
+		closed      bool
+		mutex       sync.Mutex
+	}
+)
+
+const (
+	memoryBuffer = 64
+)
+
+var (
+	errTransportClosed = errors.New("transport closed")
+)
+
+// newMemoryTransport creates an in-process transport without subscribers.
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{}
+}
+
+// Publish passes a copy of the payload to every subscriber, blocking while a subscriber's buffer is full.
+func (m *memoryTransport) Publish(message []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return errTransportClosed
+	}
+	for _, subscriber := range m.subscribers {
+		subscriber <- append([]byte(nil), message...)
+	}
+	return nil
+}
+
+// Subscribe passes every payload published from now on to the handler until the transport is closed.
+func (m *memoryTransport) Subscribe(handler func(*delivery)) error {
+	subscriber := make(chan []byte, memoryBuffer)
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return errTransportClosed
+	}
+	m.subscribers = append(m.subscribers, subscriber)
+	m.mutex.Unlock()
+	for message := range subscriber {
+		deliver(handler, message, time.Now(), nil)
+	}
+	return errTransportClosed
+}
+
+// close ends all subscriptions.
+func (m *memoryTransport) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for _, subscriber := range m.subscribers {
+		close(subscriber)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	metricCounter struct {
+		name   string
+		help   string
+		labels []string
+		values map[string]float64
+		mutex  sync.Mutex
+	}
+	metricHistogram struct {
+		name    string
+		help    string
+		labels  []string
+		buckets []float64
+		series  map[string]*histogramSeries
+		mutex   sync.Mutex
+	}
+	histogramSeries struct {
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsSeparator = "\xff"
+)
+
+var (
+	durationBuckets          = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	metricPayloadsReceived   = newMetricCounter("droplets_payloads_received_total", "Payloads received per action.", "action")
+	metricPayloadsBadToken   = newMetricCounter("droplets_payloads_rejected_token_total", "Payloads rejected for a bad token or signature.")
+	metricPayloadsDenied     = newMetricCounter("droplets_payloads_denied_total", "Payloads denied for an action the sender may not send.", "action")
+	metricIdentifyTimeouts   = newMetricCounter("droplets_identify_timeouts_total", "Droplets deleted for not identifying in time.", "template")
+	metricRedisReconnects    = newMetricCounter("droplets_redis_reconnects_total", "Reconnects to Redis.")
+	metricCreateDuration     = newMetricHistogram("droplets_create_duration_seconds", "Duration of droplet file generation.", "template")
+	metricBootDuration       = newMetricHistogram("droplets_boot_duration_seconds", "Duration of droplet boot scripts.", "template")
+	metricDeleteDuration     = newMetricHistogram("droplets_delete_duration_seconds", "Duration of droplet deletions.", "template")
+	metricCounters           = []*metricCounter{metricPayloadsReceived, metricPayloadsBadToken, metricPayloadsDenied, metricIdentifyTimeouts, metricRedisReconnects}
+	metricHistograms         = []*metricHistogram{metricCreateDuration, metricBootDuration, metricDeleteDuration}
+	metricDropletsName       = "droplets_droplets"
+	metricDropletsHelp       = "Droplets by template and state."
+	metricDropletsLabelNames = []string{"template", "state"}
+	metricRedisName          = "droplets_redis_connected"
+	metricRedisHelp          = "Whether the handler is connected to Redis."
+)
+
+// newMetricCounter creates a new counter with the label names.
+func newMetricCounter(name, help string, labels ...string) *metricCounter {
+	counter := &metricCounter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		counter.values[""] = 0
+	}
+	return counter
+}
+
+// newMetricHistogram creates a new duration histogram with the label names.
+func newMetricHistogram(name, help string, labels ...string) *metricHistogram {
+	return &metricHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: durationBuckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// inc increments the counter for the label values.
+func (m *metricCounter) inc(values ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[strings.Join(values, metricsSeparator)]++
+}
+
+// observeSince records the time passed since the start for the label values.
+func (m *metricHistogram) observeSince(start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+// observe records a value for the label values.
+func (m *metricHistogram) observe(value float64, values ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := strings.Join(values, metricsSeparator)
+	series, exists := m.series[key]
+	if !exists {
+		series = &histogramSeries{
+			counts: make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = series
+	}
+	for i, bucket := range m.buckets {
+		if value <= bucket {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// write writes the counter in the Prometheus text format.
+func (m *metricCounter) write(writer io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(writer, "%s%s %s\n", m.name, formatLabels(m.labels, key), formatValue(m.values[key]))
+	}
+}
+
+// write writes the histogram in the Prometheus text format.
+func (m *metricHistogram) write(writer io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := m.series[key]
+		labels := append(append([]string{}, m.labels...), "le")
+		prefix := ""
+		if len(m.labels) > 0 {
+			prefix = key + metricsSeparator
+		}
+		for i, bucket := range m.buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", m.name, formatLabels(labels, prefix+formatValue(bucket)), series.counts[i])
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", m.name, formatLabels(labels, prefix+"+Inf"), series.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", m.name, formatLabels(m.labels, key), formatValue(series.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", m.name, formatLabels(m.labels, key), series.count)
+	}
+}
+
+// writeDropletMetrics writes the droplets by template and state in the Prometheus text format.
+func writeDropletMetrics(writer io.Writer) {
+	values := make(map[string]float64)
+	for _, template := range templates.all() {
+		for _, state := range dropletStateNames {
+			values[template.Name+metricsSeparator+state] = 0
+		}
+	}
+	droplets.forAllDroplets(func(droplet *droplet) {
+		values[droplet.template.Name+metricsSeparator+dropletStateNames[droplet.getState()]]++
+	})
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s gauge\n", metricDropletsName, metricDropletsHelp, metricDropletsName)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(writer, "%s%s %s\n", metricDropletsName, formatLabels(metricDropletsLabelNames, key), formatValue(values[key]))
+	}
+}
+
+// writeRedisMetrics writes the Redis connection state in the Prometheus text format.
+func writeRedisMetrics(writer io.Writer) {
+	connected := 0
+	if conns.isConnected() {
+		connected = 1
+	}
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s gauge\n", metricRedisName, metricRedisHelp, metricRedisName)
+	fmt.Fprintf(writer, "%s %d\n", metricRedisName, connected)
+}
+
+// listenMetrics starts the metrics endpoint.
+func listenMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeDropletMetrics(writer)
+		writeRedisMetrics(writer)
+		for _, counter := range metricCounters {
+			counter.write(writer)
+		}
+		for _, histogram := range metricHistograms {
+			histogram.write(writer)
+		}
+	})
+	slog.Info("Metrics listening.", "address", config.Metrics.Address)
+	err := http.ListenAndServe(config.Metrics.Address, mux)
+	if err != nil {
+		slog.Error("Metrics stopped.", "error", err)
+	}
+}
+
+// sortedKeys gets the sorted keys of the map.
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels formats the label names and joined values.
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, metricsSeparator)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value.
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
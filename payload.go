@@ -2,56 +2,123 @@ package main
 
 import (
 	"encoding/json"
-	"log"
-	"net"
-	"time"
-
-	"github.com/gomodule/redigo/redis"
+	"log/slog"
 )
 
-// payloadRecieve starts receiving and handling payloads.
-func payloadReceive() {
-	for {
-		switch data := conns.pubSub.Receive().(type) {
-		case redis.Message:
-			var payload Payload
-			err := json.Unmarshal(data.Data, &payload)
-			if err != nil {
-				log.Printf("Error unmarshalling payload (not JSON?): %s.\n", err.Error())
-			} else {
-				payloadHandle(&payload)
-			}
-		case error:
-			if _, typeof := data.(*net.OpError); !typeof {
-				log.Printf("Error listening to pub/sub: %s.\n", data.Error())
-			}
-			return
-		}
+// payloadReceive unmarshals and handles a received payload.
+func payloadReceive(delivery *delivery) {
+	var payload Payload
+	err := json.Unmarshal(delivery.message, &payload)
+	if err != nil {
+		slog.Warn("Error unmarshalling payload (not JSON?).", "error", err)
+	} else {
+		payloadHandle(&payload, delivery)
 	}
 }
 
 // payloadSend sends a payload.
 func payloadSend(payload *Payload) {
-	bytes, err := json.Marshal(payload)
+	outbound.enqueue(payload)
+}
+
+// payloadReply publishes a reply to a request, echoing its correlation ID.
+func payloadReply(request *Payload, action string, value interface{}) {
+	data, err := json.Marshal(value)
 	if err != nil {
-		log.Printf("Error marshalling payload: %s.\n", err.Error())
+		slog.Error("Could not marshal reply data.", "action", action, "error", err)
 		return
 	}
-	str := string(bytes)
-	_, err = conns.regular.Do("PUBLISH", payloadChannel, str)
+	payloadSend(&Payload{
+		Action:      action,
+		Sender:      payloadSenderHandler,
+		Data:        data,
+		Correlation: request.Correlation,
+	})
+}
+
+// payloadCreated publishes the result of a create request.
+// A failed request is also answered with an error, and a rejected one with the refusal.
+func payloadCreated(request *Payload, data *PayloadCreateData, droplet *droplet, err error) {
+	created := &PayloadCreatedData{
+		Template: data.Template,
+	}
 	if err != nil {
-		log.Printf("Error publishing payload: %s.\n", err.Error())
+		created.Error = errorCode(err)
+	} else {
+		created.Droplet = droplet.toPayloadEntity()
+	}
+	payloadReply(request, payloadActionCreated, created)
+	if err == nil {
+		return
+	}
+	payloadError(request, created.Error, err.Error())
+	if reason, rejected := rejectReasons[err]; rejected {
+		payloadReply(request, payloadActionReject, &PayloadRejectData{
+			Template: data.Template,
+			Data:     data.Data,
+			Reason:   reason,
+		})
 	}
 }
 
+// payloadError publishes the failure of a request.
+func payloadError(request *Payload, code, message string) {
+	payloadReply(request, payloadActionError, &PayloadErrorData{
+		Action:  request.Action,
+		Code:    code,
+		Message: message,
+	})
+}
+
+// payloadAuthorized checks whether the sender may send the payload, answering it with an error if not.
+func payloadAuthorized(request *Payload, template, target string) bool {
+	err := authorizePayload(request, template, target)
+	if err == nil {
+		return true
+	}
+	slog.Warn("Denying payload.", "action", request.Action, "sender", request.Sender, "template", template, "droplet", target)
+	metricPayloadsDenied.inc(request.Action)
+	payloadError(request, errorCodeForbidden, err.Error())
+	return false
+}
+
+// errorCode gets the machine-readable code of an error.
+func errorCode(err error) string {
+	if reason, rejected := rejectReasons[err]; rejected {
+		return reason
+	}
+	if err == errDropletDeleted {
+		return errorCodeDeleted
+	}
+	if err == errShuttingDown {
+		return errorCodeShutdown
+	}
+	return errorCodeFailed
+}
+
 // payloadHandle handles a payload.
-func payloadHandle(payload *Payload) {
+// Creates and deletes hold the delivery until they are done, so the transport does not acknowledge them before.
+func payloadHandle(payload *Payload, delivery *delivery) {
 	if payload.Sender == payloadSenderHandler {
-		log.Println("Ignoring, source is own handler.")
+		if config.isCluster() && payload.Action == payloadActionCreate {
+			clusterCreate(payload, delivery)
+			return
+		}
+		slog.Debug("Ignoring, source is own handler.", "action", payload.Action)
+		return
+	}
+	if config.isCluster() && isForeign(payload) {
+		slog.Debug("Ignoring, source is droplet of another node.", "action", payload.Action, "sender", payload.Sender)
+		return
+	}
+	if err := verifyPayload(payload, delivery.received); err != nil {
+		slog.Warn("Ignoring, payload not authenticated.", "action", payload.Action, "sender", payload.Sender, "error", err)
+		metricPayloadsBadToken.inc()
+		payloadError(payload, errorCodeUnauthorized, err.Error())
 		return
 	}
-	if payload.Token != config.Token {
-		log.Println("Ignoring, wrong payload token.")
+	metricPayloadsReceived.inc(payload.Action)
+	if !payloadAuthorized(payload, "", "") {
 		return
 	}
 	switch payload.Action {
@@ -59,86 +126,124 @@ func payloadHandle(payload *Payload) {
 		var data PayloadCreateData
 		err := json.Unmarshal(payload.Data, &data)
 		if err != nil {
-			log.Printf("Could not unmarshal droplet create data: %s.\n", err.Error())
+			slog.Warn("Could not unmarshal droplet create data.", "error", err)
+			payloadError(payload, errorCodeMalformed, err.Error())
 			return
 		}
-	loop:
-		for _, template := range templates {
-			if template.Name == data.Template {
-				go func() {
-					droplet, err := template.create(data.Data)
-					if err != nil {
-						log.Printf("Error creating droplet %s: %s.\n", droplet.identifier, err.Error())
-					} else {
-						log.Printf("Successfully created droplet %s.\n", droplet.identifier)
-						err = droplet.boot()
-						log.Printf("Attempting to boot dropelt %s.\n", droplet.identifier)
-						if err != nil {
-							log.Printf("Error booting droplet %s: %s.\n", droplet.identifier, err.Error())
-						}
-						go func() {
-							identifier := droplet.identifier
-							iid := droplet.iid
-							time.Sleep(2 * time.Minute)
-							current := droplets.get(identifier)
-							if current != nil && !current.identified && current.iid == iid {
-								log.Printf("Received no identify from droplet %s in 2 minutes, starting delete..", identifier)
-								current.delete(true)
-							}
-						}()
-					}
-				}()
-				break loop
-			}
+		if !payloadAuthorized(payload, data.Template, "") {
+			return
+		}
+		if isShuttingDown() {
+			slog.Warn("Refusing to create droplet while shutting down.", "template", data.Template)
+			payloadError(payload, errorCodeShutdown, errShuttingDown.Error())
+			return
+		}
+		if config.isCluster() && !payloadPlaced(payload, &data) {
+			return
+		}
+		template := templates.get(data.Template)
+		if template == nil {
+			slog.Warn("Received request to create droplet of unknown template.", "template", data.Template)
+			payloadError(payload, errorCodeTemplate, "unknown template "+data.Template)
+			return
 		}
+		delivery.hold()
+		go func() {
+			defer delivery.release()
+			droplet, err := createDroplet(template, data.Data)
+			if reason, rejected := rejectReasons[err]; rejected {
+				slog.Warn("Refusing to create droplet.", "template", template.Name, "reason", reason)
+			} else if err != nil {
+				slog.Error("Error creating droplet.", "template", template.Name, "error", err)
+			}
+			payloadCreated(payload, &data, droplet, err)
+		}()
 	case payloadActionDelete:
 		var data PayloadDeleteData
 		err := json.Unmarshal(payload.Data, &data)
 		if err != nil {
-			log.Printf("Could not unmarshal droplet delete data: %s.\n", err.Error())
+			slog.Warn("Could not unmarshal droplet delete data.", "error", err)
+			payloadError(payload, errorCodeMalformed, err.Error())
 			return
 		}
 		droplet := droplets.get(data.Identifier)
 		if droplet == nil {
-			log.Printf("Received request to delete invalid droplet: %s.\n", payload.Data)
-		} else {
-			go droplet.delete(false)
+			if config.isCluster() && !clusterReports(payload, data.Identifier) {
+				return
+			}
+			slog.Warn("Received request to delete invalid droplet.", "identifier", data.Identifier)
+			payloadError(payload, errorCodeDroplet, "unknown droplet "+data.Identifier)
+			return
 		}
+		if !payloadAuthorized(payload, droplet.template.Name, droplet.identifier) {
+			return
+		}
+		delivery.hold()
+		go func() {
+			defer delivery.release()
+			if err := droplet.delete(false); err != nil {
+				droplet.logger().Warn("Could not delete droplet.", "error", err)
+				payloadError(payload, errorCode(err), err.Error())
+			}
+		}()
 	case payloadActionIdentify:
 		var data PayloadDroplet
 		err := json.Unmarshal(payload.Data, &data)
 		if err != nil {
-			log.Printf("Could not unmarshal droplet identify data: %s.\n", err.Error())
+			slog.Warn("Could not unmarshal droplet identify data.", "error", err)
+			payloadError(payload, errorCodeMalformed, err.Error())
+			return
+		}
+		if !payloadAuthorized(payload, "", data.Identifier) {
 			return
 		}
 		droplet := droplets.get(payload.Sender)
 		if droplet == nil {
-			log.Printf("Received request to identify invalid droplet: %s.\n", data.Identifier)
-		} else {
-			droplet.identified = true
-			log.Printf("Droplet %s identified, port: %v.\n", droplet.identifier, droplet.port)
+			slog.Warn("Received request to identify invalid droplet.", "identifier", payload.Sender)
+			payloadError(payload, errorCodeDroplet, "unknown droplet "+payload.Sender)
+			return
+		}
+		droplet.beat()
+		droplet.setState(dropletStateIdentified)
+		droplet.recovered()
+		persistState()
+		droplet.logger().Info("Droplet identified.", "port", droplet.toPayloadEntity().Port)
+	case payloadActionHeartbeat:
+		var data PayloadHeartbeatData
+		err := json.Unmarshal(payload.Data, &data)
+		if err != nil {
+			slog.Warn("Could not unmarshal droplet heartbeat data.", "error", err)
+			payloadError(payload, errorCodeMalformed, err.Error())
+			return
 		}
+		droplet := droplets.get(payload.Sender)
+		if droplet == nil {
+			slog.Warn("Received heartbeat from invalid droplet.", "identifier", payload.Sender)
+			payloadError(payload, errorCodeDroplet, "unknown droplet "+payload.Sender)
+			return
+		}
+		droplet.beat()
+		droplet.mutex.Lock()
+		droplet.tps = data.TPS
+		droplet.players = data.Players
+		droplet.mutex.Unlock()
 	case payloadActionQuery:
 		data := &PayloadQueryData{
 			Droplets: make([]*PayloadDroplet, 0),
 		}
 		droplets.forAllDroplets(func(droplet *droplet) {
-			if !droplet.identified {
+			if !droplet.isIdentified() || droplet.isWarm() {
 				return
 			}
 			data.Droplets = append(data.Droplets, droplet.toPayloadEntity())
 		})
-		bytes, err := json.Marshal(data)
-		if err != nil {
-			log.Printf("Could not marshal droplet query data: %s.\n", err.Error())
-			return
+		if config.isCluster() {
+			// Every node answers with its own droplets, the sender merges the answers of all nodes.
+			data.Node, data.Nodes = nodeName(), cluster.count()
 		}
-		payloadSend(&Payload{
-			Action: payloadActionQuery,
-			Sender: payloadSenderHandler,
-			Data:   bytes,
-			Token:  config.Token,
-		})
+		payloadReply(payload, payloadActionQuery, data)
+	default:
+		slog.Warn("Received payload with unknown action.", "action", payload.Action, "sender", payload.Sender)
+		payloadError(payload, errorCodeAction, "unknown action "+payload.Action)
 	}
-
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	// testTimeout covers the default grace period every delete waits for.
+	testTimeout = 30 * time.Second
+)
+
+// TestPayloadFlow runs a droplet through create, identify, query and delete over the in-memory transport.
+func TestPayloadFlow(t *testing.T) {
+	dir := t.TempDir()
+	config.Token = "token"
+	config.TemplatesDir = appendSlash(filepath.Join(dir, "templates"))
+	config.TargetDir = appendSlash(filepath.Join(dir, "droplets"))
+	config.StateFile = filepath.Join(dir, stateFile)
+	template := &Template{
+		Name:      "flow",
+		MinMemory: 512,
+		MaxMemory: 1024,
+	}
+	writeTestTemplate(t, template)
+	if err := os.MkdirAll(config.TargetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	templates.replace([]*Template{template})
+	defer templates.replace(nil)
+
+	memory := newMemoryTransport()
+	defer memory.close()
+	useTransport(memory)
+	replies := make(chan *Payload, memoryBuffer)
+	go memory.Subscribe(payloadReceive)
+	go memory.Subscribe(func(delivery *delivery) {
+		var payload Payload
+		if json.Unmarshal(delivery.message, &payload) == nil && payload.Sender == payloadSenderHandler {
+			replies <- &payload
+		}
+	})
+	awaitCondition(t, "subscriptions", func() bool {
+		memory.mutex.Lock()
+		defer memory.mutex.Unlock()
+		return len(memory.subscribers) == 2
+	})
+
+	sendTestPayload(t, payloadActionCreate, payloadSenderProxy, "create", &PayloadCreateData{
+		Template: template.Name,
+		Data:     "data",
+	})
+	var created PayloadCreatedData
+	awaitReply(t, replies, payloadActionCreated, "create", &created)
+	if created.Droplet == nil {
+		t.Fatalf("create failed with %q", created.Error)
+	}
+	identifier := created.Droplet.Identifier
+	if created.Template != template.Name || created.Droplet.Data != "data" {
+		t.Fatalf("created %+v of template %q, expected droplet of %q with its data", created.Droplet, created.Template, template.Name)
+	}
+
+	sendTestPayload(t, payloadActionIdentify, identifier, "", &PayloadDroplet{
+		Identifier: identifier,
+	})
+	awaitCondition(t, "identify", func() bool {
+		droplet := droplets.get(identifier)
+		return droplet != nil && droplet.isIdentified()
+	})
+
+	sendTestPayload(t, payloadActionQuery, payloadSenderProxy, "query", struct{}{})
+	var query PayloadQueryData
+	awaitReply(t, replies, payloadActionQuery, "query", &query)
+	if len(query.Droplets) != 1 || query.Droplets[0].Identifier != identifier {
+		t.Fatalf("queried %+v, expected only %s", query.Droplets, identifier)
+	}
+
+	sendTestPayload(t, payloadActionDelete, payloadSenderProxy, "delete", &PayloadDeleteData{
+		Identifier: identifier,
+	})
+	awaitCondition(t, "delete", func() bool {
+		return !droplets.contains(identifier)
+	})
+	if fileExists(targetPath(identifier, "")) {
+		t.Fatalf("files of deleted droplet %s were not removed", identifier)
+	}
+}
+
+// writeTestTemplate writes the required files of a template with a boot script that does nothing.
+func writeTestTemplate(t *testing.T, template *Template) {
+	files := map[string]string{
+		"boot.sh":                                 "#!/bin/sh\nexit 0\n",
+		filePlugins + pluginName + ".jar":         "",
+		filePlugins + pluginName + "/config.json": "{}",
+		"server.properties":                       "server-ip=IP\nserver-port=PORT\n",
+		fileSpigot:                                "",
+	}
+	for name, contents := range files {
+		path := templatePath(template.Name, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !template.containsFiles() {
+		t.Fatal("test template is missing required files")
+	}
+}
+
+// sendTestPayload sends a payload with the data from the sender.
+func sendTestPayload(t *testing.T, action, sender, correlation string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSend(&Payload{
+		Action:      action,
+		Sender:      sender,
+		Data:        data,
+		Correlation: correlation,
+	})
+}
+
+// awaitReply waits for the reply of the handler to the request with the correlation ID and unmarshals its data.
+func awaitReply(t *testing.T, replies <-chan *Payload, action, correlation string, value interface{}) {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case reply := <-replies:
+			if reply.Correlation != correlation {
+				continue
+			}
+			if reply.Action == payloadActionError {
+				t.Fatalf("request %s failed: %s", correlation, reply.Data)
+			}
+			if reply.Action != action {
+				continue
+			}
+			if err := json.Unmarshal(reply.Data, value); err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("no reply to request %s", correlation)
+		}
+	}
+}
+
+// awaitCondition waits until the condition is met.
+func awaitCondition(t *testing.T, name string, condition func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
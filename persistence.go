@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// dropletRecord represents a persisted droplet.
+	dropletRecord struct {
+		Identifier string `json:"identifier"`
+		IP         string `json:"ip"`
+		Port       int    `json:"port"`
+		Data       string `json:"data"`
+		Template   string `json:"template"`
+		IID        uint64 `json:"iid"`
+		Identified bool   `json:"identified"`
+		Warm       bool   `json:"warm"`
+		Created    int64  `json:"created"`
+	}
+)
+
+var (
+	stateMutex sync.Mutex
+)
+
+// statePath gets the path of the state file.
+func statePath() string {
+	if config.StateFile != "" {
+		return config.StateFile
+	}
+	return stateFile
+}
+
+// persistState writes all droplets that are not being deleted to the state file.
+func persistState() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	records := make([]*dropletRecord, 0)
+	droplets.forAllDroplets(func(droplet *droplet) {
+		if droplet.getState() == dropletStateDeleting {
+			return
+		}
+		entity := droplet.toPayloadEntity()
+		records = append(records, &dropletRecord{
+			Identifier: entity.Identifier,
+			IP:         entity.IP,
+			Port:       entity.Port,
+			Data:       entity.Data,
+			Template:   droplet.template.Name,
+			IID:        droplet.iid,
+			Identified: droplet.isIdentified(),
+			Warm:       droplet.isWarm(),
+			Created:    droplet.created.Unix(),
+		})
+	})
+	path := statePath()
+	temporary := path + ".tmp"
+	err := saveData(temporary, &records)
+	if err == nil {
+		err = os.Rename(temporary, path)
+	}
+	if err != nil {
+		slog.Error("Could not persist droplet state.", "error", err)
+	}
+}
+
+// recoverState adopts the persisted droplets that are still running and cleans up everything else in the target directory.
+func recoverState() {
+	var records []*dropletRecord
+	if fileExists(statePath()) {
+		if err := loadData(statePath(), &records); err != nil {
+			slog.Error("Could not load droplet state.", "error", err)
+		}
+	}
+	adopted := make(map[string]bool)
+	for _, record := range records {
+		template := templates.get(record.Template)
+		if template == nil {
+			slog.Warn("Not adopting droplet, template no longer exists.", "identifier", record.Identifier, "template", record.Template, "iid", record.IID)
+			continue
+		}
+		if running, _ := terminalStatus(record.Identifier); !running {
+			slog.Warn("Not adopting droplet, it is no longer running.", "identifier", record.Identifier, "template", record.Template, "iid", record.IID)
+			continue
+		}
+		droplet := &droplet{
+			identifier: record.Identifier,
+			ip:         record.IP,
+			port:       record.Port,
+			data:       record.Data,
+			template:   template,
+			state:      dropletStateBooting,
+			warm:       record.Warm,
+			created:    time.Unix(record.Created, 0),
+			iid:        record.IID,
+		}
+		if record.Identified {
+			droplet.state = dropletStateIdentified
+		}
+		droplet.beat()
+		droplets.put(droplet.identifier, droplet)
+		if record.IID > atomic.LoadUint64(&internalDropletHandlerID) {
+			atomic.StoreUint64(&internalDropletHandlerID, record.IID)
+		}
+		if !record.Identified {
+			go droplet.awaitIdentify()
+		}
+		adopted[record.Identifier] = true
+		droplet.logger().Info("Adopted running droplet.")
+	}
+	entries, err := ioutil.ReadDir(config.TargetDir)
+	if err != nil {
+		slog.Error("Could not read target directory.", "error", err)
+	}
+	for _, entry := range entries {
+		identifier := entry.Name()
+		if adopted[identifier] || !entry.IsDir() || strings.HasPrefix(identifier, ".") {
+			continue
+		}
+		slog.Info("Cleaning up orphaned droplet.", "identifier", identifier)
+		deleteTerminal(identifier)
+		deleteExists(targetPath(identifier, ""))
+	}
+	persistState()
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"log"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -10,15 +16,54 @@ import (
 type (
 	// Payload represents a base Redis payload.
 	Payload struct {
-		Action string          `json:"a"`
-		Sender string          `json:"s"`
-		Data   json.RawMessage `json:"d"`
-		Token  string          `json:"t"`
+		Action      string          `json:"a"`
+		Sender      string          `json:"s"`
+		Data        json.RawMessage `json:"d"`
+		Token       string          `json:"t,omitempty"`
+		Correlation string          `json:"c,omitempty"`
+		Timestamp   int64           `json:"m,omitempty"`
+		Signature   string          `json:"g,omitempty"`
 	}
 	// PayloadCreateData contains the create payload data.
 	PayloadCreateData struct {
 		Template string `json:"x"`
 		Data     string `json:"v"`
+		Node     string `json:"o,omitempty"`
+		Warm     bool   `json:"w,omitempty"`
+	}
+	// PayloadRejectData contains the data of a refused create request.
+	PayloadRejectData struct {
+		Template string `json:"x"`
+		Data     string `json:"v"`
+		Reason   string `json:"r"`
+	}
+	// PayloadCreatedData contains the result of a create request, either the new droplet or an error code.
+	PayloadCreatedData struct {
+		Template string          `json:"x"`
+		Droplet  *PayloadDroplet `json:"d,omitempty"`
+		Error    string          `json:"e,omitempty"`
+	}
+	// PayloadErrorData contains the failure of a request.
+	PayloadErrorData struct {
+		Action  string `json:"a"`
+		Code    string `json:"e"`
+		Message string `json:"m"`
+	}
+	// PayloadCrashData contains the data of a crashed droplet.
+	PayloadCrashData struct {
+		Droplet *PayloadDroplet `json:"d"`
+		Status  int             `json:"e"`
+		Restart bool            `json:"r"`
+	}
+	// PayloadHeartbeatData contains the optional statistics of a droplet heartbeat.
+	PayloadHeartbeatData struct {
+		TPS     float64 `json:"t,omitempty"`
+		Players int     `json:"p,omitempty"`
+	}
+	// PayloadStateData contains a state change of a droplet.
+	PayloadStateData struct {
+		Droplet *PayloadDroplet `json:"d"`
+		State   string          `json:"s"`
 	}
 	// PayloadDeleteData contains the delete payload data.
 	PayloadDeleteData struct {
@@ -27,6 +72,8 @@ type (
 	// PayloadQueryData contains the query payload data.
 	PayloadQueryData struct {
 		Droplets []*PayloadDroplet `json:"l"`
+		Node     string            `json:"n,omitempty"`
+		Nodes    int               `json:"c,omitempty"`
 	}
 	// PayloadDroplet represents a droplet representation inside a payload.
 	PayloadDroplet struct {
@@ -36,12 +83,15 @@ type (
 		Data       string `json:"v"`
 	}
 	connections struct {
-		regular redis.Conn
-		pubSub  *redis.PubSubConn
+		pool       *redis.Pool
+		subscriber redis.Conn
+		connected  bool
+		closed     bool
+		mutex      sync.Mutex
 	}
 	initialRedisCommand struct {
-		command  string
-		argument interface{}
+		command   string
+		arguments []interface{}
 	}
 )
 
@@ -51,75 +101,316 @@ const (
 	payloadActionDelete     = "d"
 	payloadActionIdentify   = "i"
 	payloadActionQuery      = "q"
+	payloadActionReject     = "r"
+	payloadActionCreated    = "n"
+	payloadActionError      = "e"
+	payloadActionAssign     = "a"
+	payloadActionCrash      = "k"
+	payloadActionHeartbeat  = "h"
+	payloadActionState      = "s"
 	payloadSenderProxy      = "_"
 	payloadSenderHandler    = "#"
 	payloadSplitIdentifier  = "-"
 	payloadSplitAddress     = ":"
 	payloadSplitDropletMeta = "@"
 	payloadSplitDropletList = ","
+	rejectReasonInstances   = "instances"
+	rejectReasonMemory      = "memory"
+	errorCodeFailed         = "failed"
+	errorCodeDeleted        = "deleted"
+	errorCodeMalformed      = "malformed"
+	errorCodeTemplate       = "template"
+	errorCodeDroplet        = "droplet"
+	errorCodeAction         = "action"
+	errorCodeUnauthorized   = "unauthorized"
+	errorCodeForbidden      = "forbidden"
+	errorCodeShutdown       = "shutdown"
+	redisMinBackoff         = 1 * time.Second
+	redisMaxBackoff         = 30 * time.Second
+	redisDefaultMaxIdle     = 3
+	redisIdleTimeout        = 5 * time.Minute
+	redisHealthCheckIdle    = 10 * time.Second
 )
 
 var (
-	conns                connections
-	initialRedisCommands = []initialRedisCommand{
-		initialRedisCommand{
-			command:  "auth",
-			argument: &config.Redis.Auth,
-		},
-		initialRedisCommand{
-			command:  "select",
-			argument: &config.Redis.Database,
-		},
+	conns                = connections{}
+	errRedisDisconnected = errors.New("not connected to Redis")
+	errRedisCA           = errors.New("no certificates found in Redis CA file")
+	rejectReasons        = map[error]string{
+		errInstanceLimit: rejectReasonInstances,
+		errMemoryBudget:  rejectReasonMemory,
+		errNoNode:        rejectReasonNode,
 	}
 )
 
-// close closes all connections.
-func (c *connections) close() {
-	c.regular.Close()
-	c.pubSub.Close()
+// connectRedis starts maintaining the Redis connections and publishing queued payloads over the configured transport.
+func connectRedis() {
+	useTransport(newTransport(handlerGroup()))
+	go conns.supervise()
+	if config.isSentinel() {
+		go watchSentinels()
+	}
+}
+
+// supervise connects to Redis and receives payloads, reconnecting with backoff whenever the connection is lost.
+func (c *connections) supervise() {
+	backoff := redisMinBackoff
+	for {
+		err := c.connect()
+		if c.isClosed() {
+			return
+		}
+		if err != nil {
+			slog.Error("Could not connect to Redis.", "error", err, "retry", backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+			continue
+		}
+		backoff = redisMinBackoff
+		slog.Info("Connected to Redis, listening for payloads.")
+		err = transport.Subscribe(payloadReceive)
+		c.disconnect()
+		if c.isClosed() {
+			return
+		}
+		slog.Warn("Lost connection to Redis, reconnecting.", "error", err)
+		metricRedisReconnects.inc()
+	}
 }
 
-// connectRedis connects to the Redis server.
-func connectRedis() error {
-	regular, err1 := redisConnection()
-	pubSubRaw, err2 := redisConnection()
-	if err1 != nil {
-		panic(err1)
-	} else if err2 != nil {
-		panic(err2)
+// connect checks the connection pool.
+func (c *connections) connect() error {
+	c.mutex.Lock()
+	if c.pool == nil {
+		c.pool = newRedisPool()
 	}
-	pubSub := &redis.PubSubConn{Conn: pubSubRaw}
-	pubSub.Subscribe(payloadChannel)
-	conns = connections{
-		regular: regular,
-		pubSub:  pubSub,
+	pool := c.pool
+	c.mutex.Unlock()
+	regular := pool.Get()
+	_, err := regular.Do("PING")
+	regular.Close()
+	if err != nil {
+		return err
 	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connected = true
 	return nil
 }
 
+// subscribe dials the dedicated connection the transport receives payloads on.
+// Closing it interrupts the subscription, which makes the supervisor reconnect.
+func (c *connections) subscribe() (redis.Conn, error) {
+	con, err := redisConnection()
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.subscriber != nil {
+		c.subscriber.Close()
+	}
+	c.subscriber = con
+	return con, nil
+}
+
+// disconnect closes the current subscriber connection.
+func (c *connections) disconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.subscriber != nil {
+		c.subscriber.Close()
+	}
+	c.connected = false
+}
+
+// reset discards the pool and the subscriber connection, so the supervisor reconnects to the current primary.
+func (c *connections) reset() {
+	c.mutex.Lock()
+	pool := c.pool
+	c.pool = nil
+	c.connected = false
+	c.mutex.Unlock()
+	if pool != nil {
+		pool.Close()
+	}
+	c.disconnect()
+}
+
+// get borrows a connection from the pool.
+func (c *connections) get() (redis.Conn, error) {
+	c.mutex.Lock()
+	pool, connected := c.pool, c.connected
+	c.mutex.Unlock()
+	if !connected || pool == nil {
+		return nil, errRedisDisconnected
+	}
+	return pool.Get(), nil
+}
+
+// isConnected checks whether the connections are currently established.
+func (c *connections) isConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+// isClosed checks whether the connections have been closed for good.
+func (c *connections) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// close closes all connections for good.
+func (c *connections) close() {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	c.disconnect()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pool != nil {
+		c.pool.Close()
+	}
+}
+
+// do runs a command on a pooled connection.
+// Connection errors close the subscriber connection, which makes the supervisor reconnect.
+// Error replies of Redis leave the connections intact.
+func (c *connections) do(command string, arguments ...interface{}) (interface{}, error) {
+	con, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+	reply, err := con.Do(command, arguments...)
+	if _, replied := err.(redis.Error); err != nil && !replied {
+		c.disconnect()
+	}
+	return reply, err
+}
+
+// newRedisPool creates the pool of regular connections.
+func newRedisPool() *redis.Pool {
+	maxIdle := config.Redis.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = redisDefaultMaxIdle
+	}
+	return &redis.Pool{
+		Dial:        redisConnection,
+		MaxIdle:     maxIdle,
+		MaxActive:   config.Redis.MaxActive,
+		IdleTimeout: redisIdleTimeout,
+		TestOnBorrow: func(con redis.Conn, idle time.Time) error {
+			if time.Since(idle) < redisHealthCheckIdle {
+				return nil
+			}
+			_, err := con.Do("PING")
+			return err
+		},
+	}
+}
+
 // redisConnection creates a new Redis connection.
+// Pub/sub connections are idle until a payload arrives, so their reads override the read timeout and rely on keepAlive pings.
 func redisConnection() (con redis.Conn, err error) {
-	con, err = redis.Dial("tcp", config.toRedisString())
+	options, err := redisDialOptions()
+	if err != nil {
+		return nil, err
+	}
+	network, address := "tcp", config.toRedisString()
+	if config.isSentinel() {
+		address, err = sentinelMasterAddress()
+		if err != nil {
+			return nil, err
+		}
+	} else if config.Redis.Socket != "" {
+		network, address = "unix", config.Redis.Socket
+	}
+	con, err = redis.Dial(network, address, options...)
 	if err != nil {
 		return
 	}
-	log.Println("New connection to Redis established.")
-	for _, command := range []initialRedisCommand{
-		initialRedisCommand{
-			command:  "auth",
-			argument: config.Redis.Auth,
-		},
-		initialRedisCommand{
-			command:  "select",
-			argument: config.Redis.Database,
-		},
-	} {
-		log.Printf("Executing command %s with argument %v.\n", command.command, command.argument)
-		_, err := con.Do(command.command, command.argument)
+	slog.Info("New connection to Redis established.", "network", network, "address", address)
+	for _, command := range redisInitialCommands() {
+		slog.Debug("Executing initial Redis command.", "command", command.command)
+		_, err = con.Do(command.command, command.arguments...)
 		if err != nil {
-			return con, err
+			con.Close()
+			return nil, err
 		}
 	}
-	log.Println("All Redis commands executed.")
+	slog.Debug("All Redis commands executed.")
 	return
 }
+
+// redisDialOptions gets the timeout and TLS options of connections to Redis and the sentinels.
+func redisDialOptions() ([]redis.DialOption, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(time.Duration(config.Redis.DialTimeout) * time.Millisecond),
+		redis.DialReadTimeout(time.Duration(config.Redis.ReadTimeout) * time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(config.Redis.WriteTimeout) * time.Millisecond),
+	}
+	if config.Redis.TLS.Enabled {
+		tlsConfig, err := redisTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+	return options, nil
+}
+
+// redisInitialCommands gets the AUTH and SELECT commands, if they are configured.
+func redisInitialCommands() []initialRedisCommand {
+	commands := make([]initialRedisCommand, 0, 2)
+	if config.Redis.Auth != "" {
+		arguments := []interface{}{config.Redis.Auth}
+		if config.Redis.Username != "" {
+			arguments = []interface{}{config.Redis.Username, config.Redis.Auth}
+		}
+		commands = append(commands, initialRedisCommand{
+			command:   "auth",
+			arguments: arguments,
+		})
+	}
+	if config.Redis.Database != 0 {
+		commands = append(commands, initialRedisCommand{
+			command:   "select",
+			arguments: []interface{}{config.Redis.Database},
+		})
+	}
+	return commands
+}
+
+// redisTLSConfig creates the TLS config for Redis connections from the CA file and client certificate.
+func redisTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.Redis.TLS.ServerName,
+		InsecureSkipVerify: config.Redis.TLS.SkipVerify,
+	}
+	if tlsConfig.ServerName == "" && config.Redis.Socket == "" && !config.isSentinel() {
+		tlsConfig.ServerName = config.Redis.Host
+	}
+	if config.Redis.TLS.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.Redis.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errRedisCA
+		}
+	}
+	if config.Redis.TLS.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.Redis.TLS.CertFile, config.Redis.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
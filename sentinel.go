@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	sentinelSwitchChannel = "+switch-master"
+	sentinelRetry         = 5 * time.Second
+)
+
+var (
+	errSentinelMaster = errors.New("no sentinel knows the Redis master")
+)
+
+// isSentinel checks whether the Redis primary is discovered through sentinels.
+func (c *Config) isSentinel() bool {
+	return c.Redis.Sentinel.Master != ""
+}
+
+// sentinelConnection creates a new connection to the sentinel at the address.
+// Sentinels are reached with the TLS settings of Redis, but authenticate with their own user.
+func sentinelConnection(address string) (redis.Conn, error) {
+	options, err := redisDialOptions()
+	if err != nil {
+		return nil, err
+	}
+	if config.Redis.Sentinel.Username != "" {
+		options = append(options, redis.DialUsername(config.Redis.Sentinel.Username))
+	}
+	if config.Redis.Sentinel.Auth != "" {
+		options = append(options, redis.DialPassword(config.Redis.Sentinel.Auth))
+	}
+	return redis.Dial("tcp", address, options...)
+}
+
+// sentinelMasterAddress asks the sentinels for the address of the current Redis primary.
+func sentinelMasterAddress() (string, error) {
+	for _, address := range config.Redis.Sentinel.Addresses {
+		con, err := sentinelConnection(address)
+		if err != nil {
+			slog.Warn("Could not connect to sentinel.", "sentinel", address, "error", err)
+			continue
+		}
+		master, err := redis.Strings(con.Do("SENTINEL", "get-master-addr-by-name", config.Redis.Sentinel.Master))
+		con.Close()
+		if err != nil || len(master) != 2 {
+			slog.Warn("Sentinel does not know the master.", "sentinel", address, "master", config.Redis.Sentinel.Master, "error", err)
+			continue
+		}
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+	return "", errSentinelMaster
+}
+
+// watchSentinels follows failover notifications and rebuilds the Redis connections when the primary switches.
+func watchSentinels() {
+	for {
+		for _, address := range config.Redis.Sentinel.Addresses {
+			err := watchSentinel(address)
+			slog.Warn("Lost connection to sentinel.", "sentinel", address, "error", err)
+			time.Sleep(sentinelRetry)
+		}
+	}
+}
+
+// watchSentinel listens to the failover notifications of one sentinel until the connection fails.
+func watchSentinel(address string) error {
+	con, err := sentinelConnection(address)
+	if err != nil {
+		return err
+	}
+	pubSub := &redis.PubSubConn{Conn: con}
+	defer pubSub.Close()
+	if err = pubSub.Subscribe(sentinelSwitchChannel); err != nil {
+		return err
+	}
+	slog.Info("Following sentinel failover notifications.", "sentinel", address)
+	stop := keepAlive(pubSub)
+	defer stop()
+	for {
+		switch data := pubSub.ReceiveWithTimeout(pubSubHealthCheck + pubSubReadMargin).(type) {
+		case redis.Message:
+			// The message has the format <master> <old ip> <old port> <new ip> <new port>.
+			fields := strings.Fields(string(data.Data))
+			if len(fields) != 5 || fields[0] != config.Redis.Sentinel.Master {
+				continue
+			}
+			slog.Warn("Redis master switched, rebuilding connections.", "master", net.JoinHostPort(fields[3], fields[4]))
+			conns.reset()
+		case error:
+			return data
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -19,9 +20,9 @@ func executeSpecial(handler func(*exec.Cmd), command string, args ...string) err
 	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Error executing command %s with arguments %v: %s\n", command, args, err.Error())
+		slog.Error("Error executing command.", "command", command, "arguments", args, "error", err)
 	}
-	log.Printf("Execute output (%d): %s\n", len(out), strings.TrimSpace(string(out)))
+	slog.Debug("Execute output.", "command", command, "length", len(out), "output", strings.TrimSpace(string(out)))
 	return err
 }
 
@@ -29,3 +30,31 @@ func executeSpecial(handler func(*exec.Cmd), command string, args ...string) err
 func deleteTerminal(identifier string) {
 	execute("tmux", "kill-session", "-t", identifier)
 }
+
+// sendTerminal types the command into the console of the terminal and submits it.
+func sendTerminal(identifier, command string) error {
+	if err := execute("tmux", "send-keys", "-t", identifier, "-l", command); err != nil {
+		return err
+	}
+	return execute("tmux", "send-keys", "-t", identifier, "Enter")
+}
+
+// terminalStatus checks whether the process in the terminal is still running.
+// If it is not, the exit status is returned, or -1 if the terminal no longer exists.
+func terminalStatus(identifier string) (running bool, status int) {
+	out, err := exec.Command("tmux", "list-panes", "-t", identifier, "-F", "#{pane_dead} #{pane_dead_status}").Output()
+	if err != nil {
+		return false, -1
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || fields[0] != "1" {
+		return true, 0
+	}
+	status = -1
+	if len(fields) > 1 {
+		if code, err := strconv.Atoi(fields[1]); err == nil {
+			status = code
+		}
+	}
+	return false, status
+}
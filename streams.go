@@ -0,0 +1,290 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	streamTransport struct {
+		stream    string
+		group     string
+		consumer  string
+		maxLength int
+		claimIdle time.Duration
+		handling  map[string]bool
+		mutex     sync.Mutex
+	}
+	streamEntry struct {
+		id      string
+		added   time.Time
+		payload []byte
+	}
+)
+
+const (
+	streamField            = "p"
+	streamBlock            = 5 * time.Second
+	streamReadMargin       = 5 * time.Second
+	streamCount            = 16
+	streamDefaultGroup     = "handler"
+	streamDefaultMaxLength = 10000
+	streamDefaultClaimIdle = 60
+)
+
+// newStreamTransport creates a Redis Streams transport for the consumer group.
+func newStreamTransport(group string) *streamTransport {
+	stream := config.Transport.Stream
+	if stream == "" {
+		stream = payloadChannel
+	}
+	consumer := config.Transport.Consumer
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	maxLength := config.Transport.MaxLength
+	if maxLength == 0 {
+		maxLength = streamDefaultMaxLength
+	}
+	claimIdle := config.Transport.ClaimIdle
+	if claimIdle == 0 {
+		claimIdle = streamDefaultClaimIdle
+	}
+	return &streamTransport{
+		stream:    stream,
+		group:     group,
+		consumer:  consumer,
+		maxLength: maxLength,
+		claimIdle: time.Duration(claimIdle) * time.Second,
+		handling:  make(map[string]bool),
+	}
+}
+
+// handlerGroup gets the consumer group of the handler.
+func handlerGroup() string {
+	if config.Transport.Group != "" {
+		return config.Transport.Group
+	}
+	if config.isCluster() {
+		// Every node has to receive every payload.
+		return streamDefaultGroup + payloadSplitIdentifier + nodeName()
+	}
+	return streamDefaultGroup
+}
+
+// Publish appends the payload to the stream, trimming old entries.
+func (s *streamTransport) Publish(message []byte) error {
+	_, err := conns.do("XADD", s.stream, "MAXLEN", "~", s.maxLength, "*", streamField, message)
+	return err
+}
+
+// Subscribe reads the stream as a member of the consumer group, acknowledging each entry once it is handled.
+// Entries left pending by this consumer or by consumers that went away are reclaimed first.
+func (s *streamTransport) Subscribe(handler func(*delivery)) error {
+	con, err := conns.subscribe()
+	if err != nil {
+		return err
+	}
+	if s.group == "" {
+		return s.follow(con, handler)
+	}
+	_, err = con.Do("XGROUP", "CREATE", s.stream, s.group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	if err = s.reclaimOwn(con, handler); err != nil {
+		return err
+	}
+	if err = s.reclaimStale(con, handler); err != nil {
+		return err
+	}
+	for {
+		entries, err := s.read(con, ">")
+		if err != nil {
+			return err
+		}
+		s.handle(entries, handler)
+	}
+}
+
+// reclaimOwn handles the entries that were delivered to this consumer before, but never acknowledged.
+func (s *streamTransport) reclaimOwn(con redis.Conn, handler func(*delivery)) error {
+	last := "0"
+	for {
+		entries, err := s.read(con, last)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		slog.Info("Reclaiming pending stream entries.", "stream", s.stream, "entries", len(entries))
+		s.handle(entries, handler)
+		last = entries[len(entries)-1].id
+	}
+}
+
+// reclaimStale claims and handles the entries other consumers left pending for too long.
+func (s *streamTransport) reclaimStale(con redis.Conn, handler func(*delivery)) error {
+	start := "0-0"
+	for {
+		reply, err := redis.Values(con.Do("XAUTOCLAIM", s.stream, s.group, s.consumer, s.claimIdle.Milliseconds(), start, "COUNT", streamCount))
+		if err != nil || len(reply) < 2 {
+			return err
+		}
+		start, err = redis.String(reply[0], nil)
+		if err != nil {
+			return err
+		}
+		entries, err := parseStreamEntries(reply[1])
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			slog.Info("Claimed stale stream entries.", "stream", s.stream, "entries", len(entries))
+		}
+		s.handle(entries, handler)
+		if start == "0-0" {
+			return nil
+		}
+	}
+}
+
+// read reads the entries after the ID as a member of the consumer group, blocking for new ones.
+func (s *streamTransport) read(con redis.Conn, id string) ([]*streamEntry, error) {
+	reply, err := redis.DoWithTimeout(con, streamBlock+streamReadMargin, "XREADGROUP", "GROUP", s.group, s.consumer,
+		"COUNT", streamCount, "BLOCK", streamBlock.Milliseconds(), "STREAMS", s.stream, id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	return parseStreamReply(reply)
+}
+
+// handle passes the entries to the handler, acknowledging each once the work it started is done.
+// Entries still being handled, e.g. when they are reclaimed after a reconnect, are skipped.
+func (s *streamTransport) handle(entries []*streamEntry, handler func(*delivery)) {
+	for _, entry := range entries {
+		id := entry.id
+		if !s.track(id) {
+			continue
+		}
+		if entry.payload == nil {
+			s.ack(id)
+			continue
+		}
+		deliver(handler, entry.payload, entry.added, func() {
+			s.ack(id)
+		})
+	}
+}
+
+// track marks the entry as being handled, reporting whether it was not already.
+func (s *streamTransport) track(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.handling[id] {
+		return false
+	}
+	s.handling[id] = true
+	return true
+}
+
+// ack acknowledges the handled entry on a pooled connection.
+// Entries that could not be acknowledged stay pending and are handled again after the next reconnect.
+func (s *streamTransport) ack(id string) {
+	if _, err := conns.do("XACK", s.stream, s.group, id); err != nil {
+		slog.Warn("Could not acknowledge stream entry.", "stream", s.stream, "id", id, "error", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.handling, id)
+}
+
+// follow reads new entries of the stream without a consumer group.
+func (s *streamTransport) follow(con redis.Conn, handler func(*delivery)) error {
+	last := "0-0"
+	latest, err := redis.Values(con.Do("XREVRANGE", s.stream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return err
+	}
+	if entries, err := parseStreamEntries(latest); err == nil && len(entries) > 0 {
+		last = entries[0].id
+	}
+	for {
+		reply, err := redis.DoWithTimeout(con, streamBlock+streamReadMargin, "XREAD", "COUNT", streamCount,
+			"BLOCK", streamBlock.Milliseconds(), "STREAMS", s.stream, last)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			continue
+		}
+		entries, err := parseStreamReply(reply)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.payload != nil {
+				deliver(handler, entry.payload, entry.added, nil)
+			}
+			last = entry.id
+		}
+	}
+}
+
+// parseStreamReply parses the entries of the first stream in an XREAD or XREADGROUP reply.
+func parseStreamReply(reply interface{}) ([]*streamEntry, error) {
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) < 2 {
+		return nil, err
+	}
+	return parseStreamEntries(stream[1])
+}
+
+// parseStreamEntries parses a list of stream entries, each consisting of an ID and field value pairs.
+func parseStreamEntries(reply interface{}) ([]*streamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*streamEntry, 0, len(values))
+	for _, value := range values {
+		raw, err := redis.Values(value, nil)
+		if err != nil || len(raw) < 2 {
+			continue
+		}
+		id, err := redis.String(raw[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		entry := &streamEntry{
+			id:    id,
+			added: streamEntryTime(id),
+		}
+		// Entries deleted by trimming have no fields.
+		fields, _ := redis.ByteSlices(raw[1], nil)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == streamField {
+				entry.payload = fields[i+1]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// streamEntryTime gets the time Redis added the entry at, which is the first part of its ID.
+func streamEntryTime(id string) time.Time {
+	milliseconds, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.UnixMilli(milliseconds)
+}
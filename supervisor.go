@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	heartbeatActionDelete      = "delete"
+	heartbeatActionRestart     = "restart"
+	heartbeatStateUnresponsive = "unresponsive"
+	supervisorInterval         = 10 * time.Second
+	defaultRestartBackoff      = 5
+	defaultMissedBeats         = 3
+	maxRestartBackoff          = 5 * time.Minute
+)
+
+// superviseDroplets periodically checks whether the processes of all booted droplets are still alive.
+func superviseDroplets() {
+	for {
+		time.Sleep(supervisorInterval)
+		droplets.forAllDroplets(func(droplet *droplet) {
+			state := droplet.getState()
+			if state != dropletStateBooting && state != dropletStateIdentified {
+				return
+			}
+			running, status := terminalStatus(droplet.identifier)
+			if !running {
+				if droplet.transition(state, dropletStateCrashed) {
+					go droplet.crashed(status)
+				}
+			} else if state == dropletStateIdentified && droplet.missedHeartbeats() && droplet.transition(state, dropletStateCrashed) {
+				go droplet.unresponsive()
+			}
+		})
+	}
+}
+
+// crashed handles a droplet whose process is no longer running, restarting or deleting it according to the template.
+func (d *droplet) crashed(status int) {
+	retries := atomic.LoadInt32(&d.retries)
+	restart := d.template.shouldRestart(status, int(retries))
+	d.logger().Warn("Droplet crashed.", "status", status, "restart", restart)
+	data, err := json.Marshal(&PayloadCrashData{
+		Droplet: d.toPayloadEntity(),
+		Status:  status,
+		Restart: restart,
+	})
+	if err != nil {
+		d.logger().Error("Could not marshal droplet crash data.", "error", err)
+	} else {
+		payloadSend(&Payload{
+			Action: payloadActionCrash,
+			Sender: payloadSenderHandler,
+			Data:   data,
+		})
+	}
+	if isShuttingDown() {
+		// The shutdown deletes the droplet.
+		return
+	}
+	if !restart {
+		d.delete(true)
+		return
+	}
+	backoff := d.template.restartBackoff(int(retries))
+	d.logger().Info("Restarting droplet.", "backoff", backoff)
+	time.Sleep(backoff)
+	if d.getState() != dropletStateCrashed || droplets.get(d.identifier) != d || isShuttingDown() {
+		return
+	}
+	atomic.AddInt32(&d.retries, 1)
+	d.restart()
+}
+
+// recovered resets the crash restarts of the droplet once it identified, so the retries of the template limit consecutive crashes.
+func (d *droplet) recovered() {
+	atomic.StoreInt32(&d.retries, 0)
+}
+
+// beat records a sign of life from the droplet.
+func (d *droplet) beat() {
+	atomic.StoreInt64(&d.lastSeen, time.Now().UnixNano())
+}
+
+// missedHeartbeats checks whether the droplet missed too many heartbeats, if heartbeats are enabled.
+func (d *droplet) missedHeartbeats() bool {
+	if config.Heartbeat.Interval == 0 {
+		return false
+	}
+	missed := config.Heartbeat.Missed
+	if missed == 0 {
+		missed = defaultMissedBeats
+	}
+	deadline := time.Duration(config.Heartbeat.Interval*missed) * time.Second
+	return time.Since(time.Unix(0, atomic.LoadInt64(&d.lastSeen))) > deadline
+}
+
+// unresponsive handles a droplet that stopped sending heartbeats, restarting or deleting it according to the config.
+func (d *droplet) unresponsive() {
+	d.logger().Warn("Droplet stopped sending heartbeats.")
+	data, err := json.Marshal(&PayloadStateData{
+		Droplet: d.toPayloadEntity(),
+		State:   heartbeatStateUnresponsive,
+	})
+	if err != nil {
+		d.logger().Error("Could not marshal droplet state data.", "error", err)
+	} else {
+		payloadSend(&Payload{
+			Action: payloadActionState,
+			Sender: payloadSenderHandler,
+			Data:   data,
+		})
+	}
+	if isShuttingDown() {
+		// The shutdown deletes the droplet.
+		return
+	}
+	if config.Heartbeat.Action == heartbeatActionRestart {
+		d.restart()
+	} else {
+		d.delete(true)
+	}
+}
+
+// restart stops the droplet and boots it again.
+// A droplet whose process is still running is given the stop sequence of its template, so it can save its data.
+func (d *droplet) restart() error {
+	// The supervisor leaves the droplet alone until it is booted again.
+	d.setState(dropletStateCreated)
+	if d.getState() == dropletStateDeleting {
+		return errDropletDeleted
+	}
+	atomic.AddInt32(&d.restarts, 1)
+	if running, _ := terminalStatus(d.identifier); running {
+		d.stop()
+	} else {
+		deleteTerminal(d.identifier)
+	}
+	err := d.boot()
+	if err != nil {
+		d.logger().Error("Error rebooting droplet.", "error", err)
+		// The droplet was not booted, so the supervisor would never notice it is not running.
+		if d.transition(dropletStateCreated, dropletStateCrashed) {
+			go d.crashed(-1)
+		}
+		return err
+	}
+	go d.awaitIdentify()
+	return nil
+}
+
+// shouldRestart checks whether a droplet of the template that exited with the status should be restarted.
+func (t *Template) shouldRestart(status, restarts int) bool {
+	if t.MaxRetries > 0 && restarts >= t.MaxRetries {
+		return false
+	}
+	switch t.RestartPolicy {
+	case restartPolicyAlways:
+		return true
+	case restartPolicyOnFailure:
+		return status != 0
+	}
+	return false
+}
+
+// restartBackoff calculates the exponential delay before the next restart.
+func (t *Template) restartBackoff(restarts int) time.Duration {
+	base := t.RestartBackoff
+	if base == 0 {
+		base = defaultRestartBackoff
+	}
+	backoff := time.Duration(base) * time.Second
+	for i := 0; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return backoff
+}
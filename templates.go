@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	templateList struct {
+		templates []*Template
+		mutex     sync.RWMutex
+	}
+	// templateReport contains the validation results of a template.
+	templateReport struct {
+		Template *Template `json:"template"`
+		Valid    bool      `json:"valid"`
+		Files    bool      `json:"files"`
+	}
+)
+
+// get gets a template by name.
+func (t *templateList) get(name string) *Template {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, template := range t.templates {
+		if template.Name == name {
+			return template
+		}
+	}
+	return nil
+}
+
+// all gets a snapshot of all registered templates.
+func (t *templateList) all() []*Template {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	snapshot := make([]*Template, len(t.templates))
+	copy(snapshot, t.templates)
+	return snapshot
+}
+
+// replace swaps the registered templates for a new set.
+// Droplets keep the template pointer they were created with, which is kept for templates whose definition did not change.
+func (t *templateList) replace(templates []*Template) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, template := range templates {
+		for _, current := range t.templates {
+			if reflect.DeepEqual(current, template) {
+				templates[i] = current
+			}
+		}
+	}
+	t.templates = templates
+}
+
+// validateTemplates reads the template file and validates every template in it.
+func validateTemplates() ([]*templateReport, error) {
+	var localTemplates []*Template
+	err := loadData(templateFile, &localTemplates)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*templateReport, 0, len(localTemplates))
+	for _, template := range localTemplates {
+		report := &templateReport{
+			Template: template,
+			Valid:    template.isValid(),
+		}
+		report.Files = report.Valid && template.containsFiles()
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// loadTemplates reads the template file and returns all valid templates.
+func loadTemplates() ([]*Template, error) {
+	reports, err := validateTemplates()
+	if err != nil {
+		return nil, err
+	}
+	valid := make([]*Template, 0, len(reports))
+	for _, report := range reports {
+		if !report.Valid {
+			slog.Warn("Template is invalid.", "template", report.Template.Name)
+		} else if !report.Files {
+			slog.Warn("Template does not contain all required files.", "template", report.Template.Name)
+		} else {
+			slog.Info("Registered template.", "template", report.Template.Name)
+			valid = append(valid, report.Template)
+		}
+	}
+	return valid, nil
+}
+
+// reloadTemplates reloads the templates, keeping the current ones if the file can not be read.
+func reloadTemplates() error {
+	slog.Info("Reloading templates...")
+	loaded, err := loadTemplates()
+	if err != nil {
+		slog.Error("Could not reload templates, keeping current ones.", "error", err)
+		return err
+	}
+	templates.replace(loaded)
+	slog.Info("Template reload completed.", "templates", len(loaded))
+	return nil
+}
+
+// watchTemplates periodically checks the template file and directory for changes and reloads on change.
+func watchTemplates(interval time.Duration) {
+	last := templatesFingerprint()
+	for {
+		time.Sleep(interval)
+		current := templatesFingerprint()
+		if current != last {
+			slog.Info("Detected template changes.")
+			reloadTemplates()
+			last = current
+		}
+	}
+}
+
+// templatesFingerprint summarizes the modification state of the template file and directory.
+func templatesFingerprint() string {
+	var count, size, latest int64
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		count++
+		size += info.Size()
+		if modified := info.ModTime().UnixNano(); modified > latest {
+			latest = modified
+		}
+		return nil
+	}
+	if info, err := os.Stat(templateFile); err == nil {
+		visit(templateFile, info, nil)
+	}
+	filepath.Walk(config.TemplatesDir, visit)
+	return strconv.FormatInt(count, 10) + "/" + strconv.FormatInt(size, 10) + "/" + strconv.FormatInt(latest, 10)
+}
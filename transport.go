@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// Transport delivers payloads between the handler, the proxies and the droplets.
+	Transport interface {
+		// Publish publishes a marshalled payload.
+		Publish(message []byte) error
+		// Subscribe passes every received payload to the handler until the subscription fails.
+		// A payload is acknowledged once the handler returned and released every hold it put on the delivery.
+		Subscribe(handler func(*delivery)) error
+	}
+	// delivery is a payload received over a transport.
+	delivery struct {
+		message  []byte
+		received time.Time
+		holds    int32
+		handled  func()
+	}
+	pubSubTransport struct {
+		channel string
+	}
+	payloadQueue struct {
+		messages chan *Payload
+		pending  int64
+		closed   int32
+	}
+)
+
+const (
+	transportPubSub   = "pubsub"
+	transportStreams  = "streams"
+	pubSubHealthCheck = 15 * time.Second
+	pubSubReadMargin  = 5 * time.Second
+	queueSize         = 1024
+	queueRetry        = 1 * time.Second
+	queueFlush        = 10 * time.Second
+)
+
+var (
+	transport Transport
+	outbound  = payloadQueue{
+		messages: make(chan *Payload, queueSize),
+	}
+)
+
+// useTransport makes the handler publish queued payloads over the transport.
+// Receiving is left to the caller, as Redis transports are subscribed by the connection supervisor.
+func useTransport(t Transport) {
+	transport = t
+	go outbound.publishAll()
+}
+
+// newTransport creates the configured transport. For streams, the group may be left empty to follow the stream without acknowledging.
+func newTransport(group string) Transport {
+	if config.Transport.Type == transportStreams {
+		return newStreamTransport(group)
+	}
+	return &pubSubTransport{
+		channel: payloadChannel,
+	}
+}
+
+// Publish publishes the payload on the channel using a pooled connection.
+func (p *pubSubTransport) Publish(message []byte) error {
+	_, err := conns.do("PUBLISH", p.channel, message)
+	return err
+}
+
+// Subscribe subscribes to the channel on a dedicated connection, checking its health periodically.
+func (p *pubSubTransport) Subscribe(handler func(*delivery)) error {
+	con, err := conns.subscribe()
+	if err != nil {
+		return err
+	}
+	pubSub := &redis.PubSubConn{Conn: con}
+	if err = pubSub.Subscribe(p.channel); err != nil {
+		return err
+	}
+	stop := keepAlive(pubSub)
+	defer stop()
+	for {
+		switch data := pubSub.ReceiveWithTimeout(pubSubHealthCheck + pubSubReadMargin).(type) {
+		case redis.Message:
+			deliver(handler, data.Data, time.Now(), nil)
+		case error:
+			if _, typeof := data.(*net.OpError); !typeof {
+				slog.Error("Error listening to pub/sub.", "error", data)
+			}
+			return data
+		}
+	}
+}
+
+// keepAlive pings the pub/sub connection periodically until it is stopped.
+// A connection that died silently then fails the next receive, which has to time out after pubSubHealthCheck and pubSubReadMargin,
+// instead of blocking it forever.
+func keepAlive(pubSub *redis.PubSubConn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pubSubHealthCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if pubSub.Ping("") != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// deliver passes the message received at the time to the handler.
+// Handled is called once the handler and the work it held the delivery for are done.
+func deliver(handler func(*delivery), message []byte, received time.Time, handled func()) {
+	delivery := &delivery{
+		message:  message,
+		received: received,
+		handled:  handled,
+	}
+	delivery.hold()
+	handler(delivery)
+	delivery.release()
+}
+
+// hold keeps the delivery from being acknowledged until it is released, e.g. by work running in the background.
+func (d *delivery) hold() {
+	atomic.AddInt32(&d.holds, 1)
+}
+
+// release releases a hold on the delivery, acknowledging it when none are left.
+func (d *delivery) release() {
+	if atomic.AddInt32(&d.holds, -1) == 0 && d.handled != nil {
+		d.handled()
+	}
+}
+
+// enqueue queues a payload to be published, dropping it if the queue is full.
+func (q *payloadQueue) enqueue(payload *Payload) {
+	atomic.AddInt64(&q.pending, 1)
+	select {
+	case q.messages <- payload:
+	default:
+		atomic.AddInt64(&q.pending, -1)
+		slog.Error("Outbound payload queue is full, dropping payload.")
+	}
+}
+
+// publishAll publishes queued payloads, retrying until they are published while the transport is unavailable.
+// Payloads are signed right before each attempt, so the ones queued during an outage are not rejected as too old.
+// Payloads Redis refuses with an error reply are dropped, as publishing them again would fail the same way.
+func (q *payloadQueue) publishAll() {
+	for payload := range q.messages {
+		for {
+			authenticatePayload(payload)
+			message, err := json.Marshal(payload)
+			if err != nil {
+				slog.Error("Error marshalling payload.", "error", err)
+				break
+			}
+			err = transport.Publish(message)
+			if err == nil {
+				break
+			}
+			if _, replied := err.(redis.Error); replied {
+				slog.Error("Redis refused payload, dropping it.", "error", err)
+				break
+			}
+			if atomic.LoadInt32(&q.closed) == 1 {
+				slog.Warn("Dropping payload, outbound queue is closed.")
+				break
+			}
+			slog.Warn("Could not publish payload, retrying.", "error", err)
+			time.Sleep(queueRetry)
+		}
+		atomic.AddInt64(&q.pending, -1)
+	}
+}
+
+// flush waits until all queued payloads are published or the timeout passes.
+func (q *payloadQueue) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&q.pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// close stops retrying, so payloads that cannot be published are dropped.
+func (q *payloadQueue) close() {
+	atomic.StoreInt32(&q.closed, 1)
+}
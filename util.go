@@ -1,28 +1,111 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-// initiateLock handles the droplet lock. Return value determines whether app is allowed to run.
-func initiateLock() bool {
-	if !fileExists(lockFile) {
-		_, err := os.Create(lockFile)
+var (
+	lock        *os.File
+	errLockHeld = errors.New("lock is held by another handler")
+)
+
+// initiateLock takes the advisory lock of the handler and writes the PID of the process into it.
+// The lock is released by the kernel when the process dies, so a lock file left behind after a crash is taken over.
+// Forcing removes the lock file first, even if another handler holds it.
+func initiateLock(force bool) error {
+	path := lockPath()
+	if force {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		slog.Warn("Forcibly removed lock.", "path", path)
+	}
+	file, err := acquireLock(path)
+	if err != nil {
+		return err
+	}
+	pid := lockPID(file)
+	if pid != 0 && pid != os.Getpid() {
+		if syscall.Kill(pid, 0) == nil {
+			slog.Warn("Taking over lock that is not held, although its PID is alive.", "path", path, "pid", pid)
+		} else {
+			slog.Info("Taking over stale lock of dead process.", "path", path, "pid", pid)
+		}
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	lock = file
+	return nil
+}
+
+// acquireLock opens and locks the lock file.
+// Another handler may remove the file between opening and locking it, leaving a lock on a file nobody else can find,
+// so the file is opened again until the locked one is the one at the path.
+func acquireLock(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			pid := lockPID(file)
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("%w (PID %d)", errLockHeld, pid)
+			}
+			return nil, err
+		}
+		locked, err := file.Stat()
 		if err != nil {
-			panic(err)
+			file.Close()
+			return nil, err
 		}
-		return true
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
 	}
-	return false
 }
 
-// removeLock removes the lock.
+// lockPID reads the PID recorded in the lock file, which is 0 if there is none.
+func lockPID(file *os.File) int {
+	contents := make([]byte, 32)
+	n, _ := file.ReadAt(contents, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(contents[:n])))
+	return pid
+}
+
+// lockPath gets the path of the lock file.
+func lockPath() string {
+	if config.LockFile != "" {
+		return config.LockFile
+	}
+	return lockFile
+}
+
+// removeLock releases and removes the lock.
+// The file is removed while still locked, handlers that lock it afterwards notice it is no longer at the path.
 func removeLock() {
-	if err := os.Remove(lockFile); err != nil {
-		panic(err)
+	if lock == nil {
+		return
 	}
+	if err := os.Remove(lockPath()); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Could not remove lock.", "error", err)
+	}
+	syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	lock.Close()
+	lock = nil
 }
 
 // appends a slash to the string, if it does not exist.
@@ -34,12 +117,12 @@ func appendSlash(origin string) string {
 }
 
 // generateDropletIdentifier generates the next available droplet identifier.
-func generateDropletIdentifier(template string) string {
+func generateDropletIdentifier(template string, taken func(string) bool) string {
 	id := 0
 	contains := true
 	for contains {
 		id++
-		contains = droplets.contains(formatDropletIdentifier(template, id))
+		contains = taken(formatDropletIdentifier(template, id))
 	}
 	return formatDropletIdentifier(template, id)
 }
@@ -48,3 +131,13 @@ func generateDropletIdentifier(template string) string {
 func formatDropletIdentifier(template string, id int) string {
 	return fmt.Sprintf("%s%s%d", template, payloadSplitIdentifier, id)
 }
+
+// contains checks whether the value is in the list.
+func contains(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}